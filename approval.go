@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+)
+
+const maxApprovalPayload = 1 << 20
+
+// approvalSecret returns the secret approvals must be signed with,
+// POST /approve is only served with it.
+func approvalSecret() string {
+	return os.Getenv("DEPLOYER_APPROVAL_SECRET")
+}
+
+// approval is the signed body of POST /approve, naming the job
+// so that a captured approval can't approve another job's artifact.
+type approval struct {
+	Key        string `json:"key"`
+	ArtifactID int64  `json:"artifactId"`
+}
+
+// isApproved reports whether artifact id was approved for the job.
+func isApproved(key string, id int64) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return jobStatus(key).Approved == id
+}
+
+// approve approves the artifact with id for the job.
+func approve(key string, id int64) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	jobStatus(key).Approved = id
+}
+
+// handlePending returns the status of the jobs with a deferred deploy.
+func handlePending(w http.ResponseWriter, r *http.Request) {
+	ss := slices.DeleteFunc(snapshotStatus(), func(s JobStatus) bool { return s.Pending == nil })
+	writeJSON(w, ss)
+}
+
+// handleApprove approves an artifact of a job requiring approval and
+// starts the next poll cycle. The body {"key": key, "artifactId": id}
+// must be signed with the approval secret and name the job and the
+// artifact, so a captured approval can't approve a later one or
+// another job's.
+func handleApprove(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	j := findJob(key)
+	if j == nil {
+		http.Error(w, "unknown job: "+key, http.StatusNotFound)
+		return
+	}
+	if !j.RequireApproval {
+		http.Error(w, "job doesn't require approval: "+key, http.StatusConflict)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxApprovalPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !validSignature(approvalSecret(), body, r.Header.Get("X-Deployer-Signature")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var a approval
+	if err := json.Unmarshal(body, &a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if a.Key != key || a.ArtifactID == 0 {
+		http.Error(w, "approvals must name the job as key and the artifactId", http.StatusBadRequest)
+		return
+	}
+	approve(key, a.ArtifactID)
+	log.Printf("[Info] Job %v approved artifact %v\n", key, a.ArtifactID)
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "approved artifact %v\n", a.ArtifactID)
+}
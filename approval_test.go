@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleApprove(t *testing.T) {
+	t.Setenv("DEPLOYER_APPROVAL_SECRET", "s")
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", RequireApproval: true}
+	other := Job{Owner: "o", Repo: "r", ArtifactName: "docs", RequireApproval: true}
+	useState(t, j, other)
+	key := jobKey(j)
+
+	for _, c := range []struct {
+		name, body, sig string
+		code            int
+	}{
+		{"unsigned", `{"key": "o.r.dist", "artifactId": 1}`, "", http.StatusUnauthorized},
+		{"wrong secret", `{"key": "o.r.dist", "artifactId": 1}`, sign("x", `{"key": "o.r.dist", "artifactId": 1}`), http.StatusUnauthorized},
+		{"other job", `{"key": "o.r.docs", "artifactId": 1}`, sign("s", `{"key": "o.r.docs", "artifactId": 1}`), http.StatusBadRequest},
+		{"no artifact", `{"key": "o.r.dist"}`, sign("s", `{"key": "o.r.dist"}`), http.StatusBadRequest},
+		{"signed", `{"key": "o.r.dist", "artifactId": 1}`, sign("s", `{"key": "o.r.dist", "artifactId": 1}`), http.StatusAccepted},
+	} {
+		r := httptest.NewRequest("POST", "/approve/"+key, strings.NewReader(c.body))
+		r.SetPathValue("key", key)
+		r.Header.Set("X-Deployer-Signature", c.sig)
+		w := httptest.NewRecorder()
+		handleApprove(w, r)
+		if w.Code != c.code {
+			t.Errorf("%v: got %v %s, want %v", c.name, w.Code, w.Body, c.code)
+		}
+		if approved := isApproved(key, 1); approved != (c.code == http.StatusAccepted) {
+			t.Errorf("%v: approved %v", c.name, approved)
+		}
+	}
+	if isApproved(jobKey(other), 1) {
+		t.Error("approved the other job")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// archiveMagic are the signatures of formats often mistaken for zips.
+var archiveMagic = []struct {
+	offset int
+	magic  string
+	name   string
+}{
+	{0, "\x1f\x8b", "gzip"},
+	{257, "ustar", "tar"},
+	{0, "7z\xbc\xaf\x27\x1c", "7z"},
+	{0, "Rar!", "rar"},
+	{0, "\xfd7zXZ\x00", "xz"},
+	{0, "BZh", "bzip2"},
+	{0, "\x28\xb5\x2f\xfd", "zstd"},
+}
+
+// checkZip reports an error naming the detected type
+// if the file doesn't start with a zip signature.
+func checkZip(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	b = b[:n]
+
+	// local file header, spanned archive marker,
+	// or the end of central directory of an empty zip
+	for _, sig := range []string{"PK\x03\x04", "PK\x07\x08", "PK\x05\x06"} {
+		if bytes.HasPrefix(b, []byte(sig)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("downloaded file is not a valid zip; got %v", detectType(b))
+}
+
+func detectType(b []byte) string {
+	if len(b) == 0 {
+		return "an empty file"
+	}
+	for _, m := range archiveMagic {
+		if len(b) >= m.offset+len(m.magic) && string(b[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return m.name
+		}
+	}
+	return http.DetectContentType(b)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// verifyAttestation verifies the build provenance attestation of the
+// downloaded artifact with the GitHub CLI, which checks the sigstore
+// signature, and that it was built in the job's repo and, if set, by
+// the job's workflow. The attestation subject must be the artifact zip,
+// e.g. attested with the artifact-digest output of actions/upload-artifact.
+func verifyAttestation(ctx context.Context, j Job, filename string) error {
+	args := []string{"attestation", "verify", filename, "--repo", j.Owner + "/" + j.Repo}
+	if ext := path.Ext(j.Workflow); ext == ".yml" || ext == ".yaml" {
+		args = append(args, "--signer-workflow", fmt.Sprintf("%s/%s/.github/workflows/%s", j.Owner, j.Repo, path.Base(j.Workflow)))
+	}
+
+	token, err := tokenFor(ctx, j)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "gh", args...)
+	cmd.Env = append(os.Environ(), "GH_TOKEN="+token)
+	if base := apiBase(j); base != defaultAPIURL {
+		// gh talks to an enterprise server by its host name
+		if u, err := url.Parse(base); err == nil {
+			cmd.Env = append(cmd.Env, "GH_HOST="+u.Host, "GH_ENTERPRISE_TOKEN="+token)
+		}
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("attestation verification failed: %v: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
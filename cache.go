@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const cacheDir = "cache"
+
+var (
+	cacheSize = flag.Uint64("cache-size", 0, "max size in MiB of the artifact cache shared by all jobs, 0 to disable")
+
+	cacheMu sync.Mutex
+)
+
+// cacheName returns the cache file for an artifact, addressed by
+// its content digest when GitHub provides one, by its ID otherwise.
+func cacheName(a *Artifact) string {
+	if algo, sum, ok := strings.Cut(a.Digest, ":"); ok && algo == "sha256" {
+		return filepath.Join(cacheDir, "sha256-"+sum+".zip")
+	}
+	// release assets and artifacts have separate ids
+	prefix := "id-"
+	if strings.Contains(a.URL, "/releases/assets/") {
+		prefix = "asset-"
+	}
+	return filepath.Join(cacheDir, prefix+strconv.FormatInt(a.ID, 10)+".zip")
+}
+
+// fileDigest returns the sha256 digest of a file in GitHub's format.
+func fileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fromCache places the cached archive of a at dest and reports
+// whether it was found. Invalid cache entries are removed.
+func fromCache(a *Artifact, dest string) bool {
+	if *cacheSize == 0 {
+		return false
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	name := cacheName(a)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	valid := a.SizeInBytes <= 0 || fi.Size() == a.SizeInBytes
+	if valid && a.Digest != "" {
+		d, err := fileDigest(name)
+		valid = err == nil && d == a.Digest
+	}
+	if !valid {
+		log.Printf("[Warn] Removing invalid cache entry %v\n", name)
+		os.Remove(name)
+		return false
+	}
+
+	if err := linkOrCopy(name, dest); err != nil {
+		log.Printf("[Error] Cache: %v\n", err)
+		return false
+	}
+	// mtime tracks the last use for pruning
+	now := clock.Now()
+	os.Chtimes(name, now, now)
+	return true
+}
+
+// addToCache stores the downloaded archive of a and prunes the cache.
+func addToCache(a *Artifact, src string) {
+	if *cacheSize == 0 {
+		return
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		log.Printf("[Error] Cache: %v\n", err)
+		return
+	}
+	if err := linkOrCopy(src, cacheName(a)); err != nil {
+		log.Printf("[Error] Cache: %v\n", err)
+		return
+	}
+	pruneCache(*cacheSize << 20)
+}
+
+// pruneCache removes the least recently used entries until
+// the cache fits in max bytes. The caller must hold cacheMu.
+func pruneCache(max uint64) {
+	es, err := os.ReadDir(cacheDir)
+	if err != nil {
+		log.Printf("[Error] Cache: %v\n", err)
+		return
+	}
+	fis := make([]os.FileInfo, 0, len(es))
+	var total uint64
+	for _, e := range es {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		fis = append(fis, fi)
+		total += uint64(fi.Size())
+	}
+	slices.SortFunc(fis, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, fi := range fis {
+		if total <= max {
+			break
+		}
+		if err := os.Remove(filepath.Join(cacheDir, fi.Name())); err != nil {
+			log.Printf("[Error] Cache: %v\n", err)
+			continue
+		}
+		total -= uint64(fi.Size())
+	}
+}
+
+// linkOrCopy makes dest a hard link to src, or a copy if
+// linking isn't possible. dest is replaced atomically.
+func linkOrCopy(src, dest string) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", dest, os.Getpid())
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		if err := copyFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
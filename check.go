@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// validateJob checks that a job definition is complete and well-formed.
+func validateJob(j Job) error {
+	switch {
+	case j.Owner == "":
+		return errors.New("owner is empty")
+	case j.Repo == "":
+		return errors.New("repo is empty")
+	case j.ArtifactName == "":
+		return errors.New("artifactName is empty")
+	case j.DeployPath == "" && len(j.Targets) == 0 && !j.SnapshotOnly:
+		return errors.New("deployPath is empty")
+	case j.SnapshotOnly && j.SnapshotPath == "":
+		return errors.New("snapshotOnly requires snapshotPath")
+	case j.SnapshotOnly && (j.DeployPath != "" || len(j.Targets) > 0):
+		return errors.New("snapshotOnly and deployPath or targets are mutually exclusive")
+	case j.DeployPath != "" && len(j.Targets) > 0:
+		return errors.New("deployPath and targets are mutually exclusive")
+	case j.CleanupPreviews && len(j.Targets) > 0:
+		return errors.New("cleanupPreviews is not supported with targets")
+	case j.RequireApproval && approvalSecret() == "":
+		return errors.New("requireApproval requires $DEPLOYER_APPROVAL_SECRET")
+	}
+	for _, t := range j.Targets {
+		if t.DeployPath == "" {
+			return errors.New("target deployPath is empty")
+		}
+		if err := validateExcludes(t.Excludes); err != nil {
+			return err
+		}
+		if err := validateTemplate(t.DeployPath); err != nil {
+			return err
+		}
+	}
+	if err := validateExcludes(j.Excludes); err != nil {
+		return err
+	}
+	for _, ph := range j.Phases {
+		if len(ph) == 0 {
+			return errors.New("phases contains an empty phase")
+		}
+		if err := validateExcludes(ph); err != nil {
+			return fmt.Errorf("phases: %v", err)
+		}
+	}
+	if err := validateAPIURL(j.APIURL); err != nil {
+		return err
+	}
+	for _, rw := range j.Rewrite {
+		if _, err := regexp.Compile(rw.Match); err != nil {
+			return fmt.Errorf("invalid rewrite %q: %v", rw.Match, err)
+		}
+	}
+	if j.MaxCompressionRatio < 0 {
+		return errors.New("maxCompressionRatio is negative")
+	}
+	if err := validateTemplate(j.DeployPath); err != nil {
+		return err
+	}
+	if err := validatePaths(j); err != nil {
+		return err
+	}
+	switch j.DiffMode {
+	case "", "hash", "mtime":
+	default:
+		return fmt.Errorf("invalid diffMode %q", j.DiffMode)
+	}
+	if j.SkipDiff && j.DiffMode != "" {
+		return errors.New("diffMode is not supported with skipDiff")
+	}
+	switch j.HashWidth {
+	case 0, 32, 128:
+	default:
+		return fmt.Errorf("invalid hashWidth %d", j.HashWidth)
+	}
+	switch j.ExtractMode {
+	case "", "temp", "direct":
+	default:
+		return fmt.Errorf("invalid extractMode %q", j.ExtractMode)
+	}
+	if err := validateMetadata(j); err != nil {
+		return err
+	}
+	if err := validateSigning(j); err != nil {
+		return err
+	}
+	if err := validateHealthCheck(j); err != nil {
+		return err
+	}
+	if err := validateInnerArchive(j); err != nil {
+		return err
+	}
+	if err := validateNameLabels(j); err != nil {
+		return err
+	}
+	if err := validateHook(j); err != nil {
+		return err
+	}
+	if err := validateNotify(j); err != nil {
+		return err
+	}
+	if err := validateWindows(j); err != nil {
+		return err
+	}
+	if _, _, err := jobModes(j); err != nil {
+		return err
+	}
+	switch j.Strategy {
+	case "", "inplace", "swap":
+	default:
+		return fmt.Errorf("invalid strategy %q", j.Strategy)
+	}
+	switch j.Target {
+	case "", "local":
+	case "exec":
+		if len(j.Command) == 0 {
+			return errors.New("command is empty")
+		}
+		if _, err := exec.LookPath(j.Command[0]); err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+	case "docker":
+		if j.Strategy == "swap" {
+			return errors.New("strategy swap is only supported for local targets")
+		}
+		if j.ExtractMode == "direct" {
+			return errors.New("extractMode direct is only supported for local targets")
+		}
+		if j.DiffMode == "mtime" {
+			return errors.New("diffMode mtime is only supported for local targets")
+		}
+		if j.Fsync {
+			return errors.New("fsync is only supported for local targets")
+		}
+		if j.OnPermissionDenied == "force" {
+			return errors.New("onPermissionDenied force is only supported for local targets")
+		}
+		if j.Container == "" {
+			return errors.New("container is empty")
+		}
+		if isTemplate(j.DeployPath) || j.CleanupPreviews || len(j.Targets) > 0 {
+			return errors.New("deployPath placeholders and targets are only supported for local targets")
+		}
+	default:
+		return fmt.Errorf("invalid target %q", j.Target)
+	}
+	if j.CleanupPreviews && !strings.Contains(j.DeployPath, "{branch}") {
+		return errors.New("cleanupPreviews requires {branch} in deployPath")
+	}
+	switch j.OnMissing {
+	case "", "error", "warn", "debug":
+	default:
+		return fmt.Errorf("invalid onMissing %q", j.OnMissing)
+	}
+	switch j.TieBreaker {
+	case "", "id", "run":
+	default:
+		return fmt.Errorf("invalid tieBreaker %q", j.TieBreaker)
+	}
+	switch j.OnOversize {
+	case "", "skip", "fail":
+	default:
+		return fmt.Errorf("invalid onOversize %q", j.OnOversize)
+	}
+	if j.MissingBackoff.Duration < 0 {
+		return errors.New("missingBackoff is negative")
+	}
+	if j.MaxPages < 0 {
+		return errors.New("maxPages is negative")
+	}
+	if j.MaxPages > 0 && j.Source == "release" {
+		return errors.New("maxPages only applies to artifacts")
+	}
+	if j.MinFiles < 0 {
+		return errors.New("minFiles is negative")
+	}
+	if j.DownloadChunks < 0 || j.DownloadChunks > maxDownloadChunks {
+		return fmt.Errorf("downloadChunks must be between 0 and %d", maxDownloadChunks)
+	}
+	switch j.OnDisallowed {
+	case "", "skip", "fail":
+	default:
+		return fmt.Errorf("invalid onDisallowed %q", j.OnDisallowed)
+	}
+	switch j.OnPermissionDenied {
+	case "", "skip", "fail", "force":
+	default:
+		return fmt.Errorf("invalid onPermissionDenied %q", j.OnPermissionDenied)
+	}
+	for _, t := range j.AllowedTypes {
+		if _, err := path.Match(t, ""); err != nil {
+			return fmt.Errorf("invalid allowed type %q: %v", t, err)
+		}
+	}
+	for k := range j.Headers {
+		if http.CanonicalHeaderKey(k) == "Authorization" && !j.OverrideAuthorization {
+			return errors.New("headers sets Authorization without overrideAuthorization")
+		}
+	}
+	switch j.Source {
+	case "", "artifact":
+		if j.Tag != "" {
+			return errors.New("tag requires source release")
+		}
+		if j.WaitForBuild && j.Workflow == "" {
+			// any run of the repo would hold up the poll cycle
+			return errors.New("waitForBuild requires workflow")
+		}
+	case "release":
+		if _, err := path.Match(j.ArtifactName, ""); err != nil {
+			return fmt.Errorf("invalid artifactName pattern %q: %v", j.ArtifactName, err)
+		}
+		if j.Workflow != "" || j.Branch != "" || j.WaitForBuild || j.Manifest != "" || j.CleanupPreviews || len(j.AllowedActors) > 0 {
+			return errors.New("workflow, branch, allowedActors, waitForBuild, manifest and cleanupPreviews are not supported for releases")
+		}
+		if j.pinned() {
+			return errors.New("pinArtifact and pinSha are not supported for releases, use tag")
+		}
+	default:
+		return fmt.Errorf("invalid source %q", j.Source)
+	}
+	if j.Manifest != "" && j.nameMatches(j.Manifest) {
+		return errors.New("manifest must be a different artifact than artifactName")
+	}
+	if j.VerifyAttestation {
+		if _, err := exec.LookPath("gh"); err != nil {
+			return errors.New("verifyAttestation requires the gh CLI")
+		}
+	}
+	if !hasToken(j) && !j.OverrideAuthorization {
+		return fmt.Errorf("no token for %v/%v", j.Owner, j.Repo)
+	}
+	return nil
+}
+
+func validateExcludes(excludes []string) error {
+	for _, e := range excludes {
+		if _, err := regexp.Compile("^" + e + "$"); err != nil {
+			return fmt.Errorf("invalid exclude %q: %v", e, err)
+		}
+	}
+	return nil
+}
+
+// checkDeployPath verifies that path is a directory, or that it
+// can be created because its parent directory exists.
+func checkDeployPath(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(filepath.Clean(path))
+		if pfi, err := os.Stat(parent); err != nil {
+			return fmt.Errorf("parent of deploy path %v: %v", path, err)
+		} else if !pfi.IsDir() {
+			return fmt.Errorf("parent of deploy path %v is not a directory", path)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("deploy path %v: %v", path, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("deploy path %v is not a directory", path)
+	}
+	return nil
+}
+
+// prepareJobs validates every job before the deployer starts
+// and creates missing deploy paths.
+func prepareJobs() {
+	if *env != "" {
+		log.Printf("[Info] Environment: %v\n", *env)
+	}
+	for _, j := range currentJobs() {
+		if err := prepareJob(j); err != nil {
+			log.Fatalf("[Error] Job %v: %v\n", jobKey(j), err)
+		}
+	}
+	warnOverlaps()
+}
+
+// prepareJob logs and validates a job and creates its missing deploy paths.
+func prepareJob(j Job) error {
+	b, _ := json.Marshal(redactJob(j))
+	log.Printf("[Info] Job %v: %s\n", jobKey(j), b)
+
+	if err := validateJob(j); err != nil {
+		return err
+	}
+	if j.SnapshotPath != "" {
+		if err := checkDeployPath(j.SnapshotPath); err != nil {
+			return fmt.Errorf("snapshot path: %v", err)
+		}
+		if err := os.MkdirAll(j.SnapshotPath, 0755); err != nil {
+			return err
+		}
+	}
+	if j.Target == "docker" {
+		return nil
+	}
+	for _, tj := range destinations(j) {
+		root := deployRoot(tj.DeployPath)
+		if err := checkDeployPath(root); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritable verifies that dir exists and files can be created in it.
+func checkWritable(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".deployer-check-*") // see deploy.Managed
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// CheckReport is the result of the check command.
+type CheckReport struct {
+	OK   bool       `json:"ok"`
+	Jobs []JobCheck `json:"jobs"`
+}
+
+type JobCheck struct {
+	Key    string  `json:"key"`
+	Checks []Check `json:"checks"`
+}
+
+type Check struct {
+	Name   string `json:"name"` // config, artifact, deployPath
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runCheck validates every job and tests connectivity without
+// downloading or deploying anything. It reports whether all checks passed.
+func runCheck() bool {
+	js := currentJobs()
+	rep := CheckReport{OK: true, Jobs: make([]JobCheck, 0, len(js))}
+	for _, j := range js {
+		jc := JobCheck{Key: jobKey(j)}
+		add := func(name, detail string, err error) {
+			c := Check{Name: name, OK: err == nil, Detail: detail}
+			if err != nil {
+				c.Error = err.Error()
+				rep.OK = false
+			}
+			jc.Checks = append(jc.Checks, c)
+		}
+
+		func() {
+			if err := validateJob(j); err != nil {
+				add("config", "", err)
+				return
+			}
+			add("config", "", nil)
+
+			if a, err := getLatestArtifact(withRequestID(context.Background(), newRequestID()), j); err != nil {
+				add("artifact", "", err)
+			} else {
+				add("artifact", fmt.Sprintf("id %v, created %v", a.ID, a.CreatedAt), nil)
+			}
+
+			if j.SnapshotPath != "" {
+				if err := checkDeployPath(j.SnapshotPath); err != nil {
+					add("snapshotPath", j.SnapshotPath, err)
+				} else {
+					add("snapshotPath", j.SnapshotPath+" writable", checkWritable(j.SnapshotPath))
+				}
+			}
+			if j.Target == "docker" {
+				t, err := newDockerTarget(context.Background(), j)
+				if err == nil {
+					err = t.Check()
+				}
+				add("deployPath", "container "+j.Container, err)
+				return
+			}
+
+			for _, tj := range destinations(j) {
+				root := deployRoot(tj.DeployPath)
+				if err := checkDeployPath(root); err != nil {
+					add("deployPath", root, err)
+					continue
+				}
+				add("deployPath", root+" writable", checkWritable(root))
+			}
+		}()
+		rep.Jobs = append(rep.Jobs, jc)
+	}
+
+	printResult(rep, func() {
+		for _, jc := range rep.Jobs {
+			for _, c := range jc.Checks {
+				switch {
+				case !c.OK:
+					fmt.Printf("[FAIL] %v: %v: %v\n", jc.Key, c.Name, c.Error)
+				case c.Detail != "":
+					fmt.Printf("[PASS] %v: %v (%v)\n", jc.Key, c.Name, c.Detail)
+				default:
+					fmt.Printf("[PASS] %v: %v\n", jc.Key, c.Name)
+				}
+			}
+		}
+		if rep.OK {
+			fmt.Println("All checks passed")
+		} else {
+			fmt.Println("Some checks failed")
+		}
+	})
+	return rep.OK
+}
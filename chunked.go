@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxDownloadChunks = 32
+	minChunkSize      = 4 << 20 // smaller archives are split into fewer chunks
+)
+
+// contentLength returns the total size from the Content-Range of a
+// response to a range request, e.g. "bytes 0-0/1234".
+func contentLength(resp *http.Response) (int64, bool) {
+	cr := resp.Header.Get("Content-Range")
+	_, total, ok := strings.Cut(cr, "/")
+	if !ok || !strings.HasPrefix(cr, "bytes ") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	return n, err == nil && n > 0
+}
+
+// downloadChunks downloads the size bytes at url into file in up to n
+// ranges in parallel. url is the signed storage URL the download was
+// redirected to, which needs no authorization.
+func downloadChunks(ctx context.Context, url string, size int64, n int, file *os.File) error {
+	chunk := max((size+int64(n)-1)/int64(n), minChunkSize)
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for start := int64(0); start < size; start += chunk {
+		end := min(start+chunk, size) - 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := downloadRange(ctx, url, start, end, file); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("bytes %d-%d: %v", start, end, err))
+				mu.Unlock()
+				cancel() // the other chunks are useless now
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("chunked download: %v", errs[0])
+	}
+	return nil
+}
+
+// downloadRange writes the bytes start to end inclusive at url into file.
+func downloadRange(ctx context.Context, url string, start, end int64, file *os.File) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", *userAgent)
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return errors.New(resp.Status)
+	}
+	if want := fmt.Sprintf("bytes %d-%d/", start, end); !strings.HasPrefix(resp.Header.Get("Content-Range"), want) {
+		return fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+	w := io.NewOffsetWriter(file, start)
+	n, err := io.Copy(w, io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced, firing the timers and tickers
+// that became due, which makes timing deterministic.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	waiting chan struct{} // signaled whenever a timer is added
+}
+
+type fakeTimer struct {
+	at     time.Time
+	period time.Duration // 0 for one-shot timers
+	c      chan time.Time
+	done   bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waiting: make(chan struct{}, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) { <-c.After(d) }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c, c.add(d, d)}
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		t.done = true
+		return t
+	}
+	c.timers = append(c.timers, t)
+	select {
+	case c.waiting <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+// Advance moves the clock forward by d and fires every timer due by then.
+// Like time.Ticker, a ticker that isn't read drops ticks.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		for !t.done && !t.at.After(c.now) {
+			select {
+			case t.c <- t.at:
+			default:
+			}
+			if t.period == 0 {
+				t.done = true
+			} else {
+				t.at = t.at.Add(t.period)
+			}
+		}
+		if !t.done {
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+}
+
+// BlockUntilWaiting blocks until a timer, sleep or ticker has been
+// added since the last call, so a caller can advance the clock only
+// once the code under test is waiting on it.
+func (c *fakeClock) BlockUntilWaiting() { <-c.waiting }
+
+type fakeTicker struct {
+	c *fakeClock
+	t *fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.c }
+
+func (t fakeTicker) Stop() {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.t.done = true
+}
+
+// useFakeClock replaces the clock with a fake one for the test.
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	c := newFakeClock(time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC))
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	tk := c.NewTicker(time.Second)
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-tk.C():
+		t.Fatal("ticked early")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	if got := <-tk.C(); !got.Equal(time.Unix(1, 0)) {
+		t.Fatalf("tick at %v, want %v", got, time.Unix(1, 0))
+	}
+	tk.Stop()
+	c.Advance(time.Second)
+	select {
+	case <-tk.C():
+		t.Fatal("ticked after Stop")
+	default:
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// findConfig returns the config file to use for filename, preferring
+// it as given and falling back to a .yaml or .yml file of the same name.
+func findConfig(filename string) string {
+	if _, err := os.Stat(filename); err == nil {
+		return filename
+	}
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, ext := range []string{".yaml", ".yml"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return filename
+}
+
+// loadConfig decodes a JSON or YAML file, detected by extension, into v.
+// YAML is converted to JSON first so both formats decode identically.
+func loadConfig(filename string, v any) error {
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+	default:
+		return loadJSON(filename, v)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return decodeConfig(b, v)
+}
+
+// decodeConfig decodes JSON or YAML into v.
+func decodeConfig(b []byte, v any) error {
+	var doc any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	jb, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(jb)).Decode(v)
+}
+
+const redacted = "REDACTED"
+
+// EffectiveConfig is the configuration in effect after applying
+// the environment overlay and defaults. It never contains tokens.
+type EffectiveConfig struct {
+	Env      string            `json:"env,omitempty"`
+	Settings map[string]string `json:"settings"` // flags
+	Headers  map[string]string `json:"headers,omitempty"`
+	Jobs     []Job             `json:"jobs"`
+}
+
+// effectiveConfig returns the resolved configuration with
+// secrets and header values redacted.
+func effectiveConfig() EffectiveConfig {
+	js := currentJobs()
+	c := EffectiveConfig{
+		Env:      *env,
+		Settings: make(map[string]string),
+		Jobs:     make([]Job, 0, len(js)),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "header" {
+			c.Settings[f.Name] = f.Value.String()
+		}
+	})
+	if len(globalHeaders) > 0 {
+		c.Headers = make(map[string]string)
+		for k := range globalHeaders {
+			c.Headers[k] = redacted
+		}
+	}
+	for _, j := range js {
+		c.Jobs = append(c.Jobs, redactJob(j))
+	}
+	return c
+}
+
+// redactJob returns j with its header values redacted, e.g. for logging.
+func redactJob(j Job) Job {
+	if len(j.Headers) > 0 {
+		hs := make(map[string]string, len(j.Headers))
+		for k := range j.Headers {
+			hs[k] = redacted
+		}
+		j.Headers = hs
+	}
+	return j
+}
+
+// runConfig prints the effective configuration.
+func runConfig() {
+	c := effectiveConfig()
+	printResult(c, func() {
+		b, _ := json.MarshalIndent(c, "", "  ")
+		os.Stdout.Write(append(b, '\n'))
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		json, yaml string
+		want       []Job
+	}{
+		{
+			name: "minimal",
+			json: `[{"owner": "o", "repo": "r", "artifactName": "dist", "deployPath": "/srv/www"}]`,
+			yaml: "- owner: o\n  repo: r\n  artifactName: dist\n  deployPath: /srv/www\n",
+			want: []Job{{Owner: "o", Repo: "r", ArtifactName: "dist", DeployPath: "/srv/www"}},
+		},
+		{
+			name: "nested",
+			json: `[{
+				"owner": "o", "repo": "r", "artifactName": "dist",
+				"excludes": ["\\.map$"],
+				"headers": {"X-Team": "web"},
+				"targets": [{"deployPath": "/a"}, {"deployPath": "/b", "excludes": ["data\\.json"]}],
+				"healthCheck": {"url": "http://127.0.0.1/healthz", "timeout": "2m"},
+				"settle": "90s",
+				"pinArtifact": 9007199254740993,
+				"skipBinary": true
+			}]`,
+			yaml: `
+- owner: o
+  repo: r
+  artifactName: dist
+  excludes: ['\.map$']
+  headers:
+    X-Team: web
+  targets:
+    - deployPath: /a
+    - deployPath: /b
+      excludes: ['data\.json']
+  healthCheck:
+    url: http://127.0.0.1/healthz
+    timeout: 2m
+  settle: 90s
+  pinArtifact: 9007199254740993
+  skipBinary: true
+`,
+			want: []Job{{
+				Owner: "o", Repo: "r", ArtifactName: "dist",
+				Excludes:    []string{`\.map$`},
+				Headers:     map[string]string{"X-Team": "web"},
+				Targets:     []Destination{{DeployPath: "/a"}, {DeployPath: "/b", Excludes: []string{`data\.json`}}},
+				HealthCheck: &HealthCheck{URL: "http://127.0.0.1/healthz", Timeout: Duration{2 * time.Minute}},
+				Settle:      Duration{90 * time.Second},
+				PinArtifact: 9007199254740993,
+				SkipBinary:  true,
+			}},
+		},
+		{
+			name: "env",
+			json: `[{"owner": "o", "repo": "r", "artifactName": "dist", "deployPath": "/srv/staging",
+				"env": {"prod": {"deployPath": "/srv/www", "labels": {"env": "prod"}}}}]`,
+			yaml: "- owner: o\n  repo: r\n  artifactName: dist\n  deployPath: /srv/staging\n  env:\n    prod:\n      deployPath: /srv/www\n      labels: {env: prod}\n",
+			want: []Job{{Owner: "o", Repo: "r", ArtifactName: "dist", DeployPath: "/srv/www", Labels: map[string]string{"env": "prod"}}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range []struct{ name, content string }{{"job.json", c.json}, {"job.yaml", c.yaml}} {
+				filename := filepath.Join(dir, f.name)
+				if err := os.WriteFile(filename, []byte(f.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				var got []Job
+				if err := loadConfig(filename, &got); err != nil {
+					t.Fatalf("%v: %v", f.name, err)
+				}
+				for i := range got {
+					if err := applyEnv(&got[i], "prod"); err != nil {
+						t.Fatalf("%v: %v", f.name, err)
+					}
+				}
+				if !reflect.DeepEqual(got, c.want) {
+					t.Errorf("%v:\n got %+v\nwant %+v", f.name, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFindConfig(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "job.json")
+	if got := findConfig(filename); got != filename {
+		t.Fatalf("without files: got %v, want %v", got, filename)
+	}
+	os.WriteFile(filepath.Join(dir, "job.yml"), nil, 0644)
+	if got := findConfig(filename); got != filepath.Join(dir, "job.yml") {
+		t.Fatalf("with job.yml: got %v", got)
+	}
+	os.WriteFile(filename, nil, 0644)
+	if got := findConfig(filename); got != filename {
+		t.Fatalf("with job.json: got %v, want %v", got, filename)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenTTL = 5 * time.Minute
+	helperTimeout   = 30 * time.Second
+)
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+var (
+	// secretMap key -> token of its helper, never persisted
+	helperTokens   = make(map[string]cachedToken)
+	helperTokensMu sync.Mutex
+)
+
+// secretFor returns the secret for the job's repo, falling back
+// to the owner-level one, and its key in secretMap.
+func secretFor(j Job) (string, Secret) {
+	prefix := profilePrefix(j.Profile)
+	secrets := currentSecrets()
+	if s, ok := secrets[prefix+j.Owner+"/"+j.Repo]; ok {
+		return prefix + j.Owner + "/" + j.Repo, s
+	}
+	return prefix + j.Owner, secrets[prefix+j.Owner]
+}
+
+// hasToken reports whether the job has a token or a helper producing one.
+func hasToken(j Job) bool {
+	_, s := secretFor(j)
+	return s.Token != "" || s.helper()
+}
+
+func (s Secret) helper() bool {
+	return len(s.TokenCommand) > 0 || s.TokenSocket != ""
+}
+
+func validateSecret(s Secret) error {
+	n := 0
+	for _, set := range []bool{s.Token != "", len(s.TokenCommand) > 0, s.TokenSocket != ""} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return errors.New("only one of token, tokenCommand and tokenSocket can be set")
+	case s.TokenTTL.Duration < 0:
+		return errors.New("tokenTtl is negative")
+	case s.TokenTTL.Duration > 0 && !s.helper():
+		return errors.New("tokenTtl requires tokenCommand or tokenSocket")
+	}
+	return validateAPIURL(s.APIURL)
+}
+
+// helperToken returns the token of the secret with key from its helper,
+// cached for its TTL.
+func helperToken(ctx context.Context, key string, s Secret) (string, error) {
+	helperTokensMu.Lock()
+	defer helperTokensMu.Unlock()
+	if c, ok := helperTokens[key]; ok && clock.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+	var token string
+	var err error
+	if s.TokenSocket != "" {
+		token, err = socketToken(ctx, s)
+	} else {
+		token, err = commandToken(ctx, s)
+	}
+	if err == nil && token == "" {
+		err = errors.New("empty token")
+	}
+	if err != nil {
+		delete(helperTokens, key)
+		return "", fmt.Errorf("token for %v: %v", key, err)
+	}
+	ttl := defaultTokenTTL
+	if s.TokenTTL.Duration > 0 {
+		ttl = s.TokenTTL.Duration
+	}
+	helperTokens[key] = cachedToken{token: token, expires: clock.Now().Add(ttl)}
+	return token, nil
+}
+
+// commandToken runs the secret's tokenCommand, which prints the token.
+func commandToken(ctx context.Context, s Secret) (string, error) {
+	cmd := exec.CommandContext(ctx, s.TokenCommand[0], s.TokenCommand[1:]...)
+	cmd.Env = append(os.Environ(), "DEPLOYER_OWNER="+s.Owner, "DEPLOYER_REPO="+s.Repo)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v: %s", s.TokenCommand[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// socketToken asks the agent listening on the secret's tokenSocket for
+// the token, writing a line with the owner, or owner/repo for a secret
+// scoped to a repo, and reading the token from the first line answered.
+func socketToken(ctx context.Context, s Secret) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", s.TokenSocket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	name := s.Owner
+	if s.Repo != "" {
+		name += "/" + s.Repo
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", name); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// forgetToken drops the cached helper token of the job.
+func forgetToken(j Job) {
+	key, _ := secretFor(j)
+	helperTokensMu.Lock()
+	defer helperTokensMu.Unlock()
+	delete(helperTokens, key)
+}
+
+// forgetTokens drops every cached helper token, e.g. once the secrets changed.
+func forgetTokens() {
+	helperTokensMu.Lock()
+	defer helperTokensMu.Unlock()
+	clear(helperTokens)
+}
@@ -0,0 +1,871 @@
+// Package deploy extracts the files of a zip archive that differ from
+// what is already deployed. It is the core of action-deployer and can be
+// used on its own, without the polling daemon.
+package deploy
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/twmb/murmur3"
+)
+
+const (
+	DiffHash  = "hash"  // compare content hashes (default)
+	DiffMtime = "mtime" // compare modification time and size
+
+	ExtractTemp   = "temp"   // hash while streaming, then stage in TempDir (default)
+	ExtractDirect = "direct" // stream into a temp file next to the destination
+
+	PermSkip  = "skip"  // leave files that can't be written as they are
+	PermFail  = "fail"  // fail the extraction once every file was tried
+	PermForce = "force" // make them writable and retry, fail if that doesn't help
+)
+
+// managedPrefix starts the names of the files the deployer itself
+// creates in a destination, such as temp files of direct extraction.
+const managedPrefix = ".deployer-"
+
+// Managed reports whether the file at path, relative to a destination,
+// belongs to the deployer rather than to a deployed artifact. Such files
+// are never extracted from an archive or carried into a swapped tree.
+func Managed(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), managedPrefix)
+}
+
+// Options control ExtractZipDiff. The zero value extracts every file
+// that differs by hash into a local directory.
+type Options struct {
+	// Regular expressions matched against whole entry names,
+	// which always use forward slashes
+	Excludes []string
+
+	// Content filters
+	SkipBinary   bool     // skip files that look binary
+	AllowedTypes []string // MIME types by extension, e.g. "text/*"
+
+	// File extensions allowed, e.g. ".html", "" for none. Other
+	// files are skipped, or fail the extraction with FailDisallowed
+	// before anything is written.
+	AllowedExtensions []string
+	FailDisallowed    bool
+
+	// Size limits in bytes, 0 means unlimited
+	MaxFileSize    uint64
+	MaxArchiveSize uint64
+	FailOversize   bool // fail instead of skipping files over MaxFileSize
+
+	// Top-level directories of the archive not to extract at all, see DirHashes
+	SkipDirs []string
+
+	// Strip the top-level directory if it's the only one and holds every
+	// entry, like tar --strip-components=1, before applying Rewrites
+	StripRoot bool
+
+	// Rules rewriting entry names to destination names, applied in order
+	// after the excludes and filters, which match the entry names
+	Rewrites []Rewrite
+
+	// Maximum uncompressed:compressed ratio of any entry, 0 means unlimited
+	MaxCompressionRatio float64
+
+	DiffMode    string // DiffHash or DiffMtime, mtime needs a local target
+	ExtractMode string // ExtractTemp or ExtractDirect, direct needs a local target
+
+	// Ordered groups of regular expressions like Excludes, matched against
+	// destination names. Files matching none are extracted first, then
+	// the files of each phase in order, e.g. the HTML referencing assets
+	// only once the assets are in place. A phase with failed files stops
+	// the extraction before the next one.
+	Phases [][]string
+
+	// Write every file without comparing it with the deployed one, e.g.
+	// for a target that can't be read back, ignoring DiffMode. Every
+	// file is then reported as written, and none as new.
+	SkipDiff bool
+
+	// Width of the MurMurHash3 content hashes of DiffHash,
+	// 32 or 128 (default), and their seed, default 0
+	HashWidth int
+	HashSeed  uint32
+
+	// What to do with files that can't be written for lack of permissions:
+	// PermSkip, PermFail or PermForce, which needs a local target. By
+	// default they're logged and counted as failed like other errors.
+	OnDenied string
+
+	// Permissions of written files, default 0644, and of created directories,
+	// default 0755 less the process umask. Both are applied exactly.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	TempDir string // staging directory for ExtractTemp, default os.TempDir()
+	Target  Target // default LocalTarget of the destination
+
+	Logger *log.Logger // nil discards logs
+	Debug  bool        // also log files without changes
+
+	DryRun bool // only report the changes, write nothing
+
+	// Sync every file to disk before renaming it into place, and the
+	// directories of the renamed files before returning, so a crash
+	// can't leave truncated files or lose renames. Needs a local target.
+	Sync bool
+}
+
+// Rewrite replaces the matches of Match in a name with Replace,
+// which may refer to submatches as in regexp.Regexp.ReplaceAllString.
+// A name rewritten to "" is skipped.
+type Rewrite struct {
+	Match   *regexp.Regexp
+	Replace string
+}
+
+// Result is the outcome of ExtractZipDiff.
+type Result struct {
+	Written []string // destination names of the entries written
+	Changes []Change // details of the entries written, in no particular order
+	Failed  int      // entries that couldn't be extracted, see the log
+	Denied  []string // destination names that couldn't be written for lack of permissions
+}
+
+// Change is an entry that was, or with DryRun would be, written.
+type Change struct {
+	Name  string `json:"name"`  // destination name
+	Entry string `json:"entry"` // name in the archive
+	Size  uint64 `json:"size"`
+	New   bool   `json:"new"` // missing from the destination before
+}
+
+type extractor struct {
+	dest string
+	opts Options
+	log  *log.Logger
+}
+
+// ExtractZipDiff extracts the files of the archive at zipPath that
+// differ from dest. Errors extracting single files are logged and
+// counted in the result, limits exceeded fail the whole extraction.
+// Once ctx is done no more files are extracted and its error is
+// returned, files already written stay in place.
+func ExtractZipDiff(ctx context.Context, zipPath, dest string, opts Options) (Result, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return Result{}, err
+	}
+	defer r.Close()
+
+	e := &extractor{dest: dest, opts: opts, log: opts.Logger}
+	if e.log == nil {
+		e.log = log.New(io.Discard, "", 0)
+	}
+	if e.opts.TempDir == "" {
+		e.opts.TempDir = os.TempDir()
+	}
+	if e.opts.Target == nil {
+		e.opts.Target = LocalTarget{Dest: dest, TempDir: e.opts.TempDir, FileMode: opts.FileMode, DirMode: opts.DirMode, Sync: opts.Sync}
+	}
+
+	// Sizes are checked against the headers up front, archive/zip
+	// fails reading any entry that exceeds its declared sizes.
+	files := make([]*zip.File, 0, len(r.File))
+	var total uint64
+	var disallowed int
+	for _, f := range r.File {
+		skip, warn, err := checkEntry(f, opts)
+		if err != nil {
+			return Result{}, err
+		}
+		if skip != "" {
+			if warn {
+				e.log.Printf("[Warn] Skipping %v: %v\n", f.Name, skip)
+			}
+			if skip == skipExtension {
+				disallowed++
+			}
+			continue
+		}
+		total += f.UncompressedSize64
+		if opts.MaxArchiveSize > 0 && total > opts.MaxArchiveSize {
+			return Result{}, fmt.Errorf("archive exceeds max archive size (%d bytes)", opts.MaxArchiveSize)
+		}
+		files = append(files, f)
+	}
+	if disallowed > 0 && opts.FailDisallowed {
+		return Result{}, fmt.Errorf("%d files with extensions not allowed, see the log", disallowed)
+	}
+
+	var root string
+	if opts.StripRoot {
+		root = commonRoot(r.File)
+	}
+
+	// files matching no phase go first
+	type entry struct {
+		f    *zip.File
+		name string
+	}
+	groups := make([][]entry, len(opts.Phases)+1)
+	for _, f := range files {
+		name := e.rename(strings.TrimPrefix(f.Name, root))
+		if name == "" {
+			continue
+		}
+		g := 0
+		for i, patterns := range opts.Phases {
+			if PathMatches(name, patterns) {
+				g = i + 1
+				break
+			}
+		}
+		groups[g] = append(groups[g], entry{f, name})
+	}
+
+	var res Result
+	var stopped error
+	mu := sync.Mutex{}
+	for phase, group := range groups {
+		if phase > 0 && res.Failed > 0 {
+			stopped = fmt.Errorf("%d files failed, phase %d and later not extracted", res.Failed, phase)
+			break
+		}
+		wg := sync.WaitGroup{}
+		for _, en := range group {
+			if ctx.Err() != nil {
+				break
+			}
+			f, name := en.f, en.name
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ctx.Err() != nil {
+					return
+				}
+				c, err := e.extractDiff(ctx, f, name)
+				if os.IsPermission(err) && e.opts.OnDenied == PermForce {
+					if ferr := e.makeWritable(name); ferr != nil {
+						e.log.Printf("[Warn] Extract %v: %v\n", f.Name, ferr)
+					} else {
+						c, err = e.extractDiff(ctx, f, name)
+					}
+				}
+				denied := os.IsPermission(err)
+				if denied && e.opts.OnDenied == PermSkip {
+					e.log.Printf("[Warn] Skipping %v: %v\n", f.Name, err)
+				} else if err != nil {
+					e.log.Printf("[Error] Extract %v: %v\n", f.Name, err)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if denied {
+					res.Denied = append(res.Denied, name)
+				}
+				if err != nil && !(denied && e.opts.OnDenied == PermSkip) {
+					res.Failed++
+				} else if c != nil {
+					res.Written = append(res.Written, name)
+					res.Changes = append(res.Changes, *c)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if opts.Sync && !opts.DryRun {
+		if err := e.syncDirs(res.Written); err != nil {
+			return res, err
+		}
+	}
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	if stopped != nil {
+		return res, stopped
+	}
+	if len(res.Denied) > 0 && (e.opts.OnDenied == PermFail || e.opts.OnDenied == PermForce) {
+		slices.Sort(res.Denied)
+		names := res.Denied
+		if len(names) > 10 {
+			names = append(names[:10:10], "...")
+		}
+		return res, fmt.Errorf("permission denied writing %d files: %v", len(res.Denied), strings.Join(names, ", "))
+	}
+	return res, nil
+}
+
+// syncDirs syncs the directories containing the written names,
+// and the directories created for them, deepest first.
+func (e *extractor) syncDirs(names []string) error {
+	dest := filepath.Clean(e.dest)
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		for dir := filepath.Dir(filepath.Join(dest, filepath.FromSlash(name))); !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			if dir == dest || !strings.HasPrefix(dir, dest+string(os.PathSeparator)) {
+				break
+			}
+		}
+	}
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	// children sort after their parents
+	slices.Sort(sorted)
+	slices.Reverse(sorted)
+	for _, dir := range sorted {
+		if err := SyncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeWritable gives the process read and write access to the
+// destination file name and the directories containing it, which
+// works if it owns them.
+func (e *extractor) makeWritable(name string) error {
+	dest := filepath.Clean(e.dest)
+	path := filepath.Join(dest, filepath.FromSlash(name))
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().IsRegular() {
+		if err := os.Chmod(path, fi.Mode().Perm()|0600); err != nil {
+			return err
+		}
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err == nil {
+			if err := os.Chmod(dir, fi.Mode().Perm()|0700); err != nil {
+				return err
+			}
+		}
+		if dir == dest || !strings.HasPrefix(dir, dest+string(os.PathSeparator)) {
+			return nil
+		}
+	}
+}
+
+const skipExtension = "extension not allowed"
+
+// checkEntry returns why f isn't extracted with opts, judging by its
+// header, and whether that's worth a warning, or an error if f fails
+// the whole extraction.
+func checkEntry(f *zip.File, opts Options) (skip string, warn bool, err error) {
+	switch {
+	case f.FileInfo().IsDir():
+		return "directory", false, nil
+	case PathMatches(f.Name, opts.Excludes):
+		return "excluded", false, nil
+	case Managed(f.Name):
+		return "name reserved for the deployer's own files", true, nil
+	case len(opts.AllowedExtensions) > 0 && !extensionAllowed(f.Name, opts.AllowedExtensions):
+		return skipExtension, true, nil
+	}
+	if dir, _, ok := strings.Cut(f.Name, "/"); ok && slices.Contains(opts.SkipDirs, dir) {
+		return "unchanged directory", false, nil
+	}
+	if opts.MaxFileSize > 0 && f.UncompressedSize64 > opts.MaxFileSize {
+		if opts.FailOversize {
+			return "", false, fmt.Errorf("%v exceeds max file size (%d > %d bytes)", f.Name, f.UncompressedSize64, opts.MaxFileSize)
+		}
+		return fmt.Sprintf("exceeds max file size (%d > %d bytes)", f.UncompressedSize64, opts.MaxFileSize), true, nil
+	}
+	if opts.MaxCompressionRatio > 0 && f.UncompressedSize64 > 0 {
+		if f.CompressedSize64 == 0 || float64(f.UncompressedSize64)/float64(f.CompressedSize64) > opts.MaxCompressionRatio {
+			return "", false, fmt.Errorf("%v exceeds max compression ratio of %v:1 (%d bytes from %d)", f.Name, opts.MaxCompressionRatio, f.UncompressedSize64, f.CompressedSize64)
+		}
+	}
+	return "", false, nil
+}
+
+// insideDest returns the path of name in dest, and whether it
+// stays inside dest, which a name like ../x doesn't (ZipSlip).
+func insideDest(dest, name string) (string, bool) {
+	path := filepath.Join(dest, filepath.FromSlash(name))
+	return path, strings.HasPrefix(path, filepath.Clean(dest)+string(os.PathSeparator))
+}
+
+// ArchiveStats returns the number and total uncompressed size
+// of the files in the archive that are not excluded.
+func ArchiveStats(zipPath string, excludes []string) (int, uint64, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	var files int
+	var size uint64
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || PathMatches(f.Name, excludes) {
+			continue
+		}
+		files++
+		size += f.UncompressedSize64
+	}
+	return files, size, nil
+}
+
+// Fingerprint returns a hash identifying the files ExtractZipDiff deploys
+// from the archive with opts, whatever was deployed before: the sha256 of
+// the lines "<sha256 of the file>  <destination name>\n" sorted by name,
+// the output of sha256sum on the files sorted by name.
+func Fingerprint(ctx context.Context, zipPath string, opts Options) (string, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	var lines []string
+	err = eachDeployed(ctx, r, opts, func(name string, rd io.Reader) error {
+		h := sha256.New()
+		if _, err := io.Copy(h, rd); err != nil {
+			return err
+		}
+		lines = append(lines, hex.EncodeToString(h.Sum(nil))+"  "+name+"\n")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slices.SortFunc(lines, func(a, b string) int { return strings.Compare(a[66:], b[66:]) })
+	h := sha256.New()
+	for _, l := range lines {
+		io.WriteString(h, l)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify re-reads the files ExtractZipDiff deploys from the archive
+// with opts and returns the destination names of those whose content
+// in dest, or opts.Target, doesn't match the archive or is missing.
+// The names in skip aren't checked, e.g. the Result.Denied skipped
+// with PermSkip.
+func Verify(ctx context.Context, zipPath, dest string, opts Options, skip []string) ([]string, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	t := opts.Target
+	if t == nil {
+		t = LocalTarget{Dest: dest}
+	}
+	var bad []string
+	err = eachDeployed(ctx, r, opts, func(name string, rd io.Reader) error {
+		if slices.Contains(skip, name) {
+			return nil
+		}
+		mb := opts.newHash()
+		if _, err := io.Copy(mb, rd); err != nil {
+			return err
+		}
+		diff, _, err := hashDiffers(opts, mb.Sum(nil), t, name)
+		if err != nil {
+			return err
+		}
+		if diff {
+			bad = append(bad, name)
+		}
+		return nil
+	})
+	return bad, err
+}
+
+// DeployedNames returns the destination names of the files
+// ExtractZipDiff deploys from the archive with opts.
+func DeployedNames(ctx context.Context, zipPath string, opts Options) ([]string, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var names []string
+	err = eachDeployed(ctx, r, opts, func(name string, rd io.Reader) error {
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+// eachDeployed calls fn with the destination name and content of
+// every file of the archive ExtractZipDiff deploys with opts.
+func eachDeployed(ctx context.Context, r *zip.ReadCloser, opts Options, fn func(name string, rd io.Reader) error) error {
+	e := &extractor{opts: opts}
+	var root string
+	if opts.StripRoot {
+		root = commonRoot(r.File)
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || PathMatches(f.Name, opts.Excludes) || Managed(f.Name) {
+			continue
+		}
+		if opts.MaxFileSize > 0 && f.UncompressedSize64 > opts.MaxFileSize {
+			continue
+		}
+		if len(opts.AllowedExtensions) > 0 && !extensionAllowed(f.Name, opts.AllowedExtensions) {
+			continue
+		}
+		name := e.rename(strings.TrimPrefix(f.Name, root))
+		if name == "" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		br := bufio.NewReaderSize(ctxReader{ctx, rc}, 8000)
+		head, err := br.Peek(8000)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			rc.Close()
+			return err
+		}
+		if ok, _ := contentAllowed(f.Name, head, opts); !ok {
+			rc.Close()
+			continue
+		}
+		err = fn(name, br)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commonRoot returns the top-level directory, with its trailing slash,
+// if every entry is below it, or "" otherwise.
+func commonRoot(files []*zip.File) string {
+	var root string
+	for _, f := range files {
+		dir, _, ok := strings.Cut(f.Name, "/")
+		if !ok || root != "" && dir != root {
+			return ""
+		}
+		root = dir
+	}
+	if root == "" {
+		return ""
+	}
+	return root + "/"
+}
+
+// rename applies the rewrite rules to an entry name.
+func (e *extractor) rename(name string) string {
+	for _, rw := range e.opts.Rewrites {
+		name = rw.Match.ReplaceAllString(name, rw.Replace)
+	}
+	return name
+}
+
+// DirHashes returns a hash of the entries of every top-level directory
+// of the archive, computed from the names, sizes and CRC-32s in the zip
+// headers without reading any content. A directory whose hash matches
+// the one of a previous extraction holds the same files, so it can be
+// passed in Options.SkipDirs. Files at the top level aren't included.
+func DirHashes(zipPath string, excludes []string) (map[string]string, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make(map[string][]*zip.File)
+	for _, f := range r.File {
+		dir, _, ok := strings.Cut(f.Name, "/")
+		if !ok || f.FileInfo().IsDir() || PathMatches(f.Name, excludes) {
+			continue
+		}
+		entries[dir] = append(entries[dir], f)
+	}
+
+	hashes := make(map[string]string, len(entries))
+	for dir, fs := range entries {
+		slices.SortFunc(fs, func(a, b *zip.File) int { return strings.Compare(a.Name, b.Name) })
+		h := sha256.New()
+		for _, f := range fs {
+			fmt.Fprintf(h, "%s\x00%08x\x00%d\n", f.Name, f.CRC32, f.UncompressedSize64)
+		}
+		hashes[dir] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// extractDiff writes f to the target as name if it differs
+// and returns the change if it was written.
+func (e *extractor) extractDiff(ctx context.Context, f *zip.File, name string) (*Change, error) {
+	// Check for ZipSlip (Directory traversal)
+	path, ok := insideDest(e.dest, name)
+	if !ok {
+		return nil, fmt.Errorf("illegal file path: %s", path)
+	}
+
+	// entries without a modification time are compared by hash
+	useMtime := e.opts.DiffMode == DiffMtime && !f.Modified.IsZero() && !e.opts.SkipDiff
+	c := &Change{Name: name, Entry: f.Name, Size: f.UncompressedSize64}
+	if useMtime {
+		fi, err := os.Stat(path)
+		if err == nil && fi.Size() == int64(f.UncompressedSize64) && !f.Modified.After(fi.ModTime()) {
+			return nil, nil
+		}
+		c.New = os.IsNotExist(err)
+	}
+
+	if e.opts.ExtractMode == ExtractDirect {
+		return e.extractDirect(ctx, f, c, useMtime)
+	}
+
+	// hash the entry while streaming it, holding only what
+	// the content filters need, so large files can be diffed
+	// and dry runs need no memory per file
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(ctxReader{ctx, rc}, 8000)
+	head, err := br.Peek(8000)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		rc.Close()
+		return nil, err
+	}
+	if ok, reason := contentAllowed(f.Name, head, e.opts); !ok {
+		rc.Close()
+		e.log.Printf("[Info] Skipping %v: %v\n", f.Name, reason)
+		return nil, nil
+	}
+	if !useMtime && !e.opts.SkipDiff {
+		mb := e.opts.newHash()
+		_, err := io.Copy(mb, br)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		diff, missing, err := hashDiffers(e.opts, mb.Sum(nil), e.opts.Target, name)
+		if err != nil {
+			return nil, err
+		} else if !diff {
+			if e.opts.Debug {
+				e.log.Printf("[Debug] No diff: %v\n", name)
+			}
+			return nil, nil
+		}
+		c.New = missing
+	} else {
+		rc.Close()
+	}
+	if e.opts.DryRun {
+		return c, nil
+	}
+	e.log.Printf("[Info] Extracting: %v\n", name)
+
+	// the entry is read again to write it, streamed into
+	// targets that support it and buffered for the others
+	if rc, err = f.Open(); err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if st, ok := e.opts.Target.(StreamTarget); ok {
+		err = st.WriteFrom(name, ctxReader{ctx, rc})
+	} else {
+		b := &bytes.Buffer{}
+		if _, err = io.Copy(b, ctxReader{ctx, rc}); err == nil {
+			err = e.opts.Target.Write(name, b)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if useMtime {
+		return c, os.Chtimes(path, f.Modified, f.Modified)
+	}
+	return c, nil
+}
+
+// extractDirect streams f into a temp file next to its destination,
+// hashing it on the way, and renames it over the destination if it differs.
+// Nothing is buffered in memory, but every file is written to disk.
+func (e *extractor) extractDirect(ctx context.Context, f *zip.File, c *Change, useMtime bool) (*Change, error) {
+	path := filepath.Join(e.dest, c.Name)
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	br := bufio.NewReaderSize(ctxReader{ctx, rc}, 8000)
+	head, err := br.Peek(8000)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if ok, reason := contentAllowed(f.Name, head, e.opts); !ok {
+		e.log.Printf("[Info] Skipping %v: %v\n", f.Name, reason)
+		return nil, nil
+	}
+
+	// a dry run only needs the hash
+	if e.opts.DryRun {
+		if e.opts.SkipDiff {
+			return c, nil
+		}
+		mb := e.opts.newHash()
+		if _, err := io.Copy(mb, br); err != nil {
+			return nil, err
+		}
+		if useMtime {
+			return c, nil
+		}
+		diff, missing, err := hashDiffers(e.opts, mb.Sum(nil), LocalTarget{Dest: e.dest}, c.Name)
+		if err != nil || !diff {
+			return nil, err
+		}
+		c.New = missing
+		return c, nil
+	}
+
+	if err := mkdirAll(filepath.Dir(path), e.opts.DirMode); err != nil {
+		return nil, err
+	}
+	t, err := os.CreateTemp(filepath.Dir(path), managedPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(t.Name()) // no-op once renamed
+
+	mb := e.opts.newHash()
+	_, err = io.Copy(io.MultiWriter(t, mb), br)
+	if err == nil && e.opts.Sync {
+		err = t.Sync()
+	}
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !useMtime && !e.opts.SkipDiff {
+		diff, missing, err := hashDiffers(e.opts, mb.Sum(nil), LocalTarget{Dest: e.dest}, c.Name)
+		if err != nil {
+			return nil, err
+		} else if !diff {
+			return nil, nil
+		}
+		c.New = missing
+	}
+	e.log.Printf("[Info] Extracting: %v\n", c.Name)
+
+	if err := os.Chmod(t.Name(), fileMode(e.opts.FileMode)); err != nil {
+		return nil, err
+	}
+	if useMtime {
+		if err := os.Chtimes(t.Name(), f.Modified, f.Modified); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Rename(t.Name(), path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ctxReader stops reading once ctx is done,
+// so copies of large files can be interrupted.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// HasDiff reports whether the content of name deployed
+// to t differs from b or is missing.
+func HasDiff(b *bytes.Buffer, t Target, name string) (bool, error) {
+	var o Options
+	diff, _, err := hashDiffers(o, o.sum(b.Bytes()), t, name)
+	return diff, err
+}
+
+// newHash returns a MurMurHash3 hash of the width and seed of o.
+func (o Options) newHash() hash.Hash {
+	if o.HashWidth == 32 {
+		return murmur3.SeedNew32(o.HashSeed)
+	}
+	return murmur3.SeedNew128(uint64(o.HashSeed), uint64(o.HashSeed))
+}
+
+// sum returns the hash of b with the width and seed of o.
+func (o Options) sum(b []byte) []byte {
+	h := o.newHash()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// hashDiffers reports whether the deployed content of name doesn't
+// match hash, made with the hash of o, and whether that's because
+// it's missing.
+func hashDiffers(o Options, hash []byte, t Target, name string) (diff, missing bool, err error) {
+	f, err := t.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, true, nil
+		}
+		return false, false, err
+	}
+	defer f.Close()
+
+	fb := o.newHash()
+	if _, err := io.Copy(fb, f); err != nil {
+		return false, false, err
+	}
+
+	return !bytes.Equal(hash, fb.Sum(nil)), false, nil
+}
+
+// OpenZip opens an archive with its entry names normalized to forward
+// slashes, which some Windows tools write as backslashes, so excludes,
+// rewrites and destination paths see the same names on every platform.
+func OpenZip(zipPath string) (*zip.ReadCloser, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		f.Name = strings.ReplaceAll(f.Name, `\`, "/")
+	}
+	return r, nil
+}
+
+// PathMatches reports whether p fully matches any of the regular expressions.
+// p is a forward-slash path whatever the OS, as are the names in an archive.
+func PathMatches(p string, excludes []string) bool {
+	p = filepath.ToSlash(p)
+	for _, e := range excludes {
+		if ok, _ := regexp.MatchString("^"+e+"$", p); ok {
+			return true
+		}
+	}
+	return false
+}
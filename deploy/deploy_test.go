@@ -0,0 +1,385 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeZip writes an archive holding files by entry name.
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "artifact.zip")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		content := files[name]
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestOpenZipBackslashNames(t *testing.T) {
+	filename := writeZip(t, map[string]string{
+		`assets\app.js`:       "app",
+		`assets\app.js.map`:   "map",
+		`assets\img\logo.svg`: "logo",
+		"index.html":          "index",
+	})
+
+	r, err := OpenZip(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	r.Close()
+	slices.Sort(names)
+	want := []string{"assets/app.js", "assets/app.js.map", "assets/img/logo.svg", "index.html"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("got names %v, want %v", names, want)
+	}
+
+	dest := t.TempDir()
+	res, err := ExtractZipDiff(context.Background(), filename, dest, Options{Excludes: []string{`assets/.*\.map`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed > 0 {
+		t.Fatalf("%d files failed", res.Failed)
+	}
+	slices.Sort(res.Written)
+	want = []string{"assets/app.js", "assets/img/logo.svg", "index.html"}
+	if !slices.Equal(res.Written, want) {
+		t.Fatalf("got written %v, want %v", res.Written, want)
+	}
+	for _, name := range want {
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, `assets\app.js`)); err == nil {
+		t.Error(`extracted a file named assets\app.js`)
+	}
+}
+
+func TestPathMatches(t *testing.T) {
+	for _, c := range []struct {
+		path    string
+		exclude string
+		want    bool
+	}{
+		{"json/a.json", `json/.*`, true},
+		{"json/a.json", `json`, false},
+		{"json/a.json", `.*\.json`, true},
+		{"a/b/c.map", `a/.*`, true},
+		{"a.json", `json/.*`, false},
+		// a Windows-style pattern escapes a backslash, which names never hold
+		{"json/a.json", `json\\.*`, false},
+		{"json/a.json", `json[\\/].*`, true},
+	} {
+		if got := PathMatches(c.path, []string{c.exclude}); got != c.want {
+			t.Errorf("PathMatches(%q, %q) = %v, want %v", c.path, c.exclude, got, c.want)
+		}
+	}
+	if !PathMatches(filepath.Join("json", "a.json"), []string{`json/.*`}) {
+		t.Error("an OS path doesn't match a forward-slash pattern")
+	}
+}
+
+// deniedTarget is a LocalTarget refusing to write files that aren't
+// writable, like a non-root user would be refused.
+type deniedTarget struct{ LocalTarget }
+
+func (t deniedTarget) check(name string) error {
+	fi, err := os.Stat(filepath.Join(t.Dest, filepath.FromSlash(name)))
+	if err == nil && fi.Mode().Perm()&0200 == 0 {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (t deniedTarget) Write(name string, b *bytes.Buffer) error {
+	if err := t.check(name); err != nil {
+		return err
+	}
+	return t.LocalTarget.Write(name, b)
+}
+
+func (t deniedTarget) WriteFrom(name string, r io.Reader) error {
+	if err := t.check(name); err != nil {
+		return err
+	}
+	return t.LocalTarget.WriteFrom(name, r)
+}
+
+func TestInsideDest(t *testing.T) {
+	dest := filepath.Join(string(os.PathSeparator), "srv", "www")
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{"index.html", true},
+		{"a/b/c.js", true},
+		{"a/../b.js", true},
+		{"../www2/x", false},
+		{"a/../../x", false},
+		{"..", false},
+		{".", false},
+	} {
+		if _, ok := insideDest(dest, c.name); ok != c.ok {
+			t.Errorf("insideDest(%q) = %v, want %v", c.name, ok, c.ok)
+		}
+	}
+}
+
+func TestExtractZipDiff(t *testing.T) {
+	zeros := strings.Repeat("\x00", 100000)
+	for _, c := range []struct {
+		name    string
+		files   map[string]string
+		locked  []string // existing files that aren't writable
+		opts    Options
+		err     string // substring of the error, if any
+		written []string
+		failed  int
+		denied  []string
+	}{
+		{
+			name:    "all",
+			files:   map[string]string{"index.html": "index", "a/b.js": "b"},
+			written: []string{"a/b.js", "index.html"},
+		},
+		{
+			name:    "zip slip",
+			files:   map[string]string{"../evil.txt": "evil", "a/../../evil.txt": "evil", "index.html": "index"},
+			written: []string{"index.html"},
+			failed:  2,
+		},
+		{
+			name:    "oversize skipped",
+			files:   map[string]string{"big.bin": strings.Repeat("x", 100), "small.txt": "small"},
+			opts:    Options{MaxFileSize: 10},
+			written: []string{"small.txt"},
+		},
+		{
+			name:  "oversize fails",
+			files: map[string]string{"big.bin": strings.Repeat("x", 100), "small.txt": "small"},
+			opts:  Options{MaxFileSize: 10, FailOversize: true},
+			err:   "exceeds max file size",
+		},
+		{
+			name:  "compression ratio",
+			files: map[string]string{"bomb.bin": zeros, "small.txt": "small"},
+			opts:  Options{MaxCompressionRatio: 10},
+			err:   "exceeds max compression ratio",
+		},
+		{
+			name:    "compression ratio below the limit",
+			files:   map[string]string{"bomb.bin": zeros},
+			opts:    Options{MaxCompressionRatio: 10000},
+			written: []string{"bomb.bin"},
+		},
+		{
+			name:    "phases",
+			files:   map[string]string{"index.html": "index", "app.js": "app"},
+			opts:    Options{Phases: [][]string{{`.*\.html`}}},
+			written: []string{"app.js", "index.html"},
+		},
+		{
+			name:    "phase barrier",
+			files:   map[string]string{"../evil.js": "evil", "app.js": "app", "index.html": "index"},
+			opts:    Options{Phases: [][]string{{`.*\.html`}}},
+			err:     "phase 1 and later not extracted",
+			written: []string{"app.js"},
+			failed:  1,
+		},
+		{
+			name:    "denied",
+			files:   map[string]string{"locked.txt": "new", "ok.txt": "ok"},
+			locked:  []string{"locked.txt"},
+			written: []string{"ok.txt"},
+			failed:  1,
+			denied:  []string{"locked.txt"},
+		},
+		{
+			name:    "denied skip",
+			files:   map[string]string{"locked.txt": "new", "ok.txt": "ok"},
+			locked:  []string{"locked.txt"},
+			opts:    Options{OnDenied: PermSkip},
+			written: []string{"ok.txt"},
+			denied:  []string{"locked.txt"},
+		},
+		{
+			name:    "denied fail",
+			files:   map[string]string{"locked.txt": "new", "ok.txt": "ok"},
+			locked:  []string{"locked.txt"},
+			opts:    Options{OnDenied: PermFail},
+			err:     "permission denied writing 1 files: locked.txt",
+			written: []string{"ok.txt"},
+			failed:  1,
+			denied:  []string{"locked.txt"},
+		},
+		{
+			name:    "denied force",
+			files:   map[string]string{"locked.txt": "new", "ok.txt": "ok"},
+			locked:  []string{"locked.txt"},
+			opts:    Options{OnDenied: PermForce},
+			written: []string{"locked.txt", "ok.txt"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			filename := writeZip(t, c.files)
+			root := t.TempDir()
+			dest := filepath.Join(root, "www")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range c.locked {
+				if err := os.WriteFile(filepath.Join(dest, name), []byte("old"), 0444); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := c.opts
+			opts.TempDir = t.TempDir()
+			opts.Target = deniedTarget{LocalTarget{Dest: dest, TempDir: opts.TempDir}}
+
+			res, err := ExtractZipDiff(context.Background(), filename, dest, opts)
+			if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Fatalf("got error %v, want %q", err, c.err)
+			}
+			slices.Sort(res.Written)
+			slices.Sort(res.Denied)
+			if !slices.Equal(res.Written, c.written) || res.Failed != c.failed || !slices.Equal(res.Denied, c.denied) {
+				t.Fatalf("got written %v, failed %d, denied %v, want %v, %d, %v", res.Written, res.Failed, res.Denied, c.written, c.failed, c.denied)
+			}
+			for name, content := range c.files {
+				b, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+				if slices.Contains(c.written, name) {
+					if string(b) != content {
+						t.Errorf("%v holds %q, %v", name, b, err)
+					}
+				} else if slices.Contains(c.locked, name) {
+					if string(b) != "old" {
+						t.Errorf("%v changed to %q", name, b)
+					}
+				} else if err == nil {
+					t.Errorf("%v was written", name)
+				}
+			}
+			if es, _ := os.ReadDir(root); len(es) != 1 {
+				t.Errorf("wrote outside of dest: %v", es)
+			}
+		})
+	}
+}
+
+func TestVerifyFingerprint(t *testing.T) {
+	filename := writeZip(t, map[string]string{
+		"site/index.html":     "index",
+		"site/app.js":         "app",
+		"site/app.js.map":     "map",
+		"site/img/logo.svg":   "logo",
+		"site/.deployer-temp": "managed",
+		"site/big.bin":        strings.Repeat("x", 100),
+	})
+	opts := Options{
+		Excludes:    []string{`.*\.map`},
+		StripRoot:   true,
+		Rewrites:    []Rewrite{{Match: regexp.MustCompile(`^img/`), Replace: "static/"}},
+		MaxFileSize: 50,
+		TempDir:     t.TempDir(),
+	}
+	dest := t.TempDir()
+	res, err := ExtractZipDiff(context.Background(), filename, dest, opts)
+	if err != nil || res.Failed > 0 {
+		t.Fatalf("extract: %v, %d failed", err, res.Failed)
+	}
+	slices.Sort(res.Written)
+	if want := []string{"app.js", "index.html", "static/logo.svg"}; !slices.Equal(res.Written, want) {
+		t.Fatalf("written %v, want %v", res.Written, want)
+	}
+
+	if bad, err := Verify(context.Background(), filename, dest, opts, nil); err != nil || len(bad) > 0 {
+		t.Fatalf("verify after extracting: %v, %v", bad, err)
+	}
+
+	// the output of sha256sum on the deployed files
+	var sums bytes.Buffer
+	for _, name := range res.Written {
+		b, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&sums, "%x  %v\n", sha256.Sum256(b), name)
+	}
+	want := sha256.Sum256(sums.Bytes())
+	fp, err := Fingerprint(context.Background(), filename, opts)
+	if err != nil || fp != "sha256:"+hex.EncodeToString(want[:]) {
+		t.Fatalf("fingerprint %v, %v, want the hash of\n%s", fp, err, sums.Bytes())
+	}
+
+	if err := os.WriteFile(filepath.Join(dest, "app.js"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dest, "static", "logo.svg")); err != nil {
+		t.Fatal(err)
+	}
+	bad, err := Verify(context.Background(), filename, dest, opts, nil)
+	slices.Sort(bad)
+	if err != nil || !slices.Equal(bad, []string{"app.js", "static/logo.svg"}) {
+		t.Fatalf("verify after changes: %v, %v", bad, err)
+	}
+	if fp2, err := Fingerprint(context.Background(), filename, opts); err != nil || fp2 != fp {
+		t.Fatalf("fingerprint changed with the deployed files: %v, %v", fp2, err)
+	}
+}
+
+func TestVerifySkipsDenied(t *testing.T) {
+	filename := writeZip(t, map[string]string{"locked.txt": "new", "ok.txt": "ok"})
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dest, "locked.txt"), []byte("old"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{OnDenied: PermSkip, TempDir: t.TempDir()}
+	opts.Target = deniedTarget{LocalTarget{Dest: dest, TempDir: opts.TempDir}}
+	res, err := ExtractZipDiff(context.Background(), filename, dest, opts)
+	if err != nil || !slices.Equal(res.Denied, []string{"locked.txt"}) {
+		t.Fatalf("extract: denied %v, %v", res.Denied, err)
+	}
+
+	if bad, err := Verify(context.Background(), filename, dest, opts, res.Denied); err != nil || len(bad) > 0 {
+		t.Fatalf("verify skipping the denied: %v, %v", bad, err)
+	}
+	if bad, err := Verify(context.Background(), filename, dest, opts, nil); err != nil || !slices.Equal(bad, []string{"locked.txt"}) {
+		t.Fatalf("verify: %v, %v", bad, err)
+	}
+}
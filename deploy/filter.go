@@ -0,0 +1,70 @@
+package deploy
+
+import (
+	"bytes"
+	"mime"
+	"path"
+	"strings"
+)
+
+// contentAllowed applies the content filters to a file,
+// returning the reason when it should be skipped.
+func contentAllowed(name string, data []byte, opts Options) (bool, string) {
+	if opts.SkipBinary && isBinary(data) {
+		return false, "binary content"
+	}
+	if len(opts.AllowedTypes) > 0 {
+		t := mimeType(name)
+		if !typeAllowed(t, opts.AllowedTypes) {
+			if t == "" {
+				t = "unknown"
+			}
+			return false, "type " + t + " not allowed"
+		}
+	}
+	return true, ""
+}
+
+// extensionAllowed reports whether the extension of name is one of
+// allowed, compared case-insensitively with or without the leading dot.
+// "" allows names without an extension.
+func extensionAllowed(name string, allowed []string) bool {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	for _, a := range allowed {
+		if strings.EqualFold(strings.TrimPrefix(a, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinary reports whether data looks binary, using the same
+// heuristic as git: a NUL byte within the first 8000 bytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// mimeType infers the media type of name from its extension,
+// without parameters such as charset.
+func mimeType(name string) string {
+	t := mime.TypeByExtension(path.Ext(name))
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = t[:i]
+	}
+	return strings.TrimSpace(t)
+}
+
+func typeAllowed(t string, allowed []string) bool {
+	if t == "" {
+		return false
+	}
+	for _, a := range allowed {
+		if ok, _ := path.Match(a, t); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Entry describes an entry of an archive and what ExtractZipDiff
+// would do with it.
+type Entry struct {
+	Name           string      `json:"name"`
+	Size           uint64      `json:"size"`
+	CompressedSize uint64      `json:"compressedSize"`
+	Mode           fs.FileMode `json:"mode"`
+	CRC32          uint32      `json:"crc32"`
+	Modified       time.Time   `json:"modified,omitempty"`
+	Symlink        bool        `json:"symlink,omitempty"` // extracted as a regular file holding the link target
+
+	Dest  string `json:"dest,omitempty"`  // destination name if it's extracted
+	Skip  string `json:"skip,omitempty"`  // why it's skipped
+	Error string `json:"error,omitempty"` // why it fails to extract, or fails the whole extraction
+}
+
+// Inspect lists the entries of the archive at zipPath and applies the
+// checks and filters of ExtractZipDiff with opts to them, without
+// extracting anything. Content filters read the start of every file.
+func Inspect(zipPath string, opts Options) ([]Entry, error) {
+	r, err := OpenZip(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	e := &extractor{opts: opts}
+	var root string
+	if opts.StripRoot {
+		root = commonRoot(r.File)
+	}
+	var total uint64
+	es := make([]Entry, 0, len(r.File))
+	for _, f := range r.File {
+		en := Entry{
+			Name:           f.Name,
+			Size:           f.UncompressedSize64,
+			CompressedSize: f.CompressedSize64,
+			Mode:           f.Mode(),
+			CRC32:          f.CRC32,
+			Modified:       f.Modified,
+			Symlink:        f.Mode()&fs.ModeSymlink != 0,
+		}
+		es = append(es, en)
+		p := &es[len(es)-1]
+
+		skip, _, err := checkEntry(f, opts)
+		if err != nil {
+			p.Error = err.Error()
+			continue
+		}
+		if skip != "" {
+			p.Skip = skip
+			continue
+		}
+		total += f.UncompressedSize64
+		if opts.MaxArchiveSize > 0 && total > opts.MaxArchiveSize {
+			p.Error = fmt.Sprintf("archive exceeds max archive size (%d bytes)", opts.MaxArchiveSize)
+			continue
+		}
+		name := e.rename(strings.TrimPrefix(f.Name, root))
+		if name == "" {
+			p.Skip = "renamed to an empty name"
+			continue
+		}
+		if _, ok := insideDest("dest", name); !ok {
+			p.Error = "illegal file path: " + name
+			continue
+		}
+		if opts.SkipBinary || len(opts.AllowedTypes) > 0 {
+			head, err := readHead(f)
+			if err != nil {
+				p.Error = err.Error()
+				continue
+			}
+			if ok, reason := contentAllowed(f.Name, head, opts); !ok {
+				p.Skip = reason
+				continue
+			}
+		}
+		p.Dest = name
+	}
+	return es, nil
+}
+
+// readHead returns the first 8000 bytes of f, as read by the content filters.
+func readHead(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	head, err := bufio.NewReaderSize(rc, 8000).Peek(8000)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	return head, nil
+}
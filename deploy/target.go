@@ -0,0 +1,119 @@
+package deploy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// Target is where the files of an archive are deployed to.
+// Names are relative to the destination.
+type Target interface {
+	// Open returns the deployed content of name,
+	// or an error satisfying os.IsNotExist if it is missing.
+	Open(name string) (io.ReadCloser, error)
+	Write(name string, b *bytes.Buffer) error
+}
+
+// StreamTarget is a Target that can also write a file from a reader, so
+// changed files are extracted without holding them in memory.
+type StreamTarget interface {
+	Target
+	WriteFrom(name string, r io.Reader) error
+}
+
+// LocalTarget deploys to a directory on the local filesystem. Files are
+// staged in TempDir and renamed into place, so it must be on the same
+// filesystem as Dest.
+type LocalTarget struct {
+	Dest     string
+	TempDir  string      // default os.TempDir()
+	FileMode os.FileMode // default 0644
+	DirMode  os.FileMode // default 0755 less the process umask
+	Sync     bool        // sync files to disk before renaming them, see Options.Sync
+}
+
+func fileMode(m os.FileMode) os.FileMode {
+	if m == 0 {
+		return 0644
+	}
+	return m
+}
+
+// mkdirAll creates dir and its missing parents with mode,
+// regardless of the umask, or like os.MkdirAll for mode 0.
+func mkdirAll(dir string, mode os.FileMode) error {
+	if mode == 0 {
+		return os.MkdirAll(dir, 0755)
+	}
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, mode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
+
+// SyncDir flushes a directory entry change such as a rename to disk.
+func SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// directories can't be synced on Windows
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (t LocalTarget) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(t.Dest, name))
+}
+
+func (t LocalTarget) Write(name string, b *bytes.Buffer) error {
+	return t.WriteFrom(name, b)
+}
+
+func (t LocalTarget) WriteFrom(name string, r io.Reader) error {
+	path := filepath.Join(t.Dest, name)
+	if err := mkdirAll(filepath.Dir(path), t.DirMode); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(t.TempDir, "extract-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	_, err = io.Copy(f, r)
+	if err == nil && t.Sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), fileMode(t.FileMode)); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/action-deployer/deploy"
+)
+
+var unified = flag.Bool("unified", false, "with diff, include unified diffs of changed text files")
+
+// maxUnifiedSize bounds the files a unified diff is made for.
+const maxUnifiedSize = 1 << 20
+
+type DiffReport struct {
+	Jobs []JobDiff `json:"jobs"`
+}
+
+type JobDiff struct {
+	Key        string       `json:"key"`
+	ArtifactID int64        `json:"artifactId,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Targets    []TargetDiff `json:"targets,omitempty"`
+}
+
+type TargetDiff struct {
+	DeployPath string       `json:"deployPath"`
+	Error      string       `json:"error,omitempty"`
+	Changes    []FileChange `json:"changes"`
+}
+
+type FileChange struct {
+	deploy.Change
+	Diff string `json:"diff,omitempty"` // unified diff, with -unified
+}
+
+// runDiff reports the files a deploy of the latest artifact would write,
+// for every job or only the one with key, without writing anything.
+func runDiff(key string) bool {
+	js := currentJobs()
+	rep := DiffReport{Jobs: make([]JobDiff, 0, len(js))}
+	ok := true
+	for _, j := range js {
+		if key != "" && jobKey(j) != key {
+			continue
+		}
+		jd := diffJob(j)
+		if jd.Error != "" {
+			ok = false
+		}
+		for _, td := range jd.Targets {
+			if td.Error != "" {
+				ok = false
+			}
+		}
+		rep.Jobs = append(rep.Jobs, jd)
+	}
+	if key != "" && len(rep.Jobs) == 0 {
+		fmt.Fprintf(os.Stderr, "unknown job: %v\n", key)
+		return false
+	}
+
+	printResult(rep, func() {
+		for _, jd := range rep.Jobs {
+			if jd.Error != "" {
+				fmt.Printf("%v: %v\n", jd.Key, jd.Error)
+				continue
+			}
+			for _, td := range jd.Targets {
+				fmt.Printf("%v: artifact %v -> %v\n", jd.Key, jd.ArtifactID, td.DeployPath)
+				if td.Error != "" {
+					fmt.Printf("  error: %v\n", td.Error)
+					continue
+				}
+				if len(td.Changes) == 0 {
+					fmt.Println("  no changes")
+				}
+				for _, c := range td.Changes {
+					op := "M"
+					if c.New {
+						op = "A"
+					}
+					fmt.Printf("  %v %v (%d bytes)\n", op, c.Name, c.Size)
+					if c.Diff != "" {
+						fmt.Print(c.Diff)
+					}
+				}
+			}
+		}
+	})
+	return ok
+}
+
+func diffJob(j Job) JobDiff {
+	key := jobKey(j)
+	jd := JobDiff{Key: key}
+	if err := validateJob(j); err != nil {
+		jd.Error = err.Error()
+		return jd
+	}
+	ctx := withRequestID(context.Background(), newRequestID())
+	artifact, err := getLatestArtifact(ctx, j)
+	if err != nil {
+		jd.Error = err.Error()
+		return jd
+	}
+	jd.ArtifactID = artifact.ID
+
+	// a separate file, the deployer may be extracting its own
+	name := key + ".diff"
+	if err := downloadArtifact(ctx, j, artifact, name); err != nil {
+		jd.Error = err.Error()
+		return jd
+	}
+	filename := filepath.Join(artifactsDir, name+".zip")
+	defer os.Remove(filename)
+	if err := unwrapArchive(j, filename); err != nil {
+		jd.Error = err.Error()
+		return jd
+	}
+
+	for _, tj := range destinations(j) {
+		td := TargetDiff{DeployPath: tj.DeployPath, Changes: []FileChange{}}
+		if err := diffTarget(ctx, tj, artifact, filename, &td); err != nil {
+			td.Error = err.Error()
+		}
+		jd.Targets = append(jd.Targets, td)
+	}
+	return jd
+}
+
+func diffTarget(ctx context.Context, j Job, artifact *Artifact, filename string, td *TargetDiff) error {
+	if isTemplate(j.DeployPath) {
+		var err error
+		if j.DeployPath, err = expandDeployPath(j.DeployPath, artifact); err != nil {
+			return err
+		}
+		td.DeployPath = j.DeployPath
+	}
+	opts, err := extractOptions(ctx, j)
+	if err != nil {
+		return err
+	}
+	opts.DryRun = true
+	opts.Logger = nil
+	if opts.Target == nil {
+		opts.Target = deploy.LocalTarget{Dest: j.DeployPath}
+	}
+	res, err := deploy.ExtractZipDiff(ctx, filename, j.DeployPath, opts)
+	if err != nil {
+		return err
+	}
+	if res.Failed > 0 {
+		return fmt.Errorf("%d files couldn't be compared", res.Failed)
+	}
+	slices.SortFunc(res.Changes, func(a, b deploy.Change) int { return strings.Compare(a.Name, b.Name) })
+
+	var r *zip.ReadCloser
+	if *unified {
+		if r, err = deploy.OpenZip(filename); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	for _, c := range res.Changes {
+		fc := FileChange{Change: c}
+		if r != nil && c.Size <= maxUnifiedSize {
+			fc.Diff = unifiedDiff(r, opts.Target, c)
+		}
+		td.Changes = append(td.Changes, fc)
+	}
+	return nil
+}
+
+// unifiedDiff returns the diff of a changed text file against the
+// deployed one, or "" for binary or unreadable files.
+func unifiedDiff(r *zip.ReadCloser, t deploy.Target, c deploy.Change) string {
+	f, err := r.Open(c.Entry)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxUnifiedSize+1))
+	if err != nil || len(b) > maxUnifiedSize || bytes.IndexByte(b, 0) >= 0 {
+		return ""
+	}
+	var old []byte
+	if !c.New {
+		o, err := t.Open(c.Name)
+		if err != nil {
+			return ""
+		}
+		defer o.Close()
+		old, err = io.ReadAll(io.LimitReader(o, maxUnifiedSize+1))
+		if err != nil || len(old) > maxUnifiedSize || bytes.IndexByte(old, 0) >= 0 {
+			return ""
+		}
+	}
+	return lineDiff(c.Name, splitLines(old), splitLines(b))
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineDiff returns a unified diff with 3 lines of context, using the
+// longest common subsequence of lines. Files too large for it are
+// reported as changed without a diff.
+func lineDiff(name string, a, b []string) string {
+	const ctxLines = 3
+	if len(a)*len(b) > 4<<20 {
+		return "    too many lines to diff\n"
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte // ' ', '-' or '+'
+		text string
+	}
+	var lines []line
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", name, name)
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+		// extend the hunk while changes are within 2*ctxLines lines
+		start := max(k-ctxLines, 0)
+		end := k
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*ctxLines {
+				break
+			}
+			end = next
+		}
+		end = min(end+ctxLines, len(lines))
+
+		// line numbers of the hunk in a and b
+		aStart, bStart := 1, 1
+		for _, l := range lines[:start] {
+			if l.op != '+' {
+				aStart++
+			}
+			if l.op != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				aLen++
+			}
+			if l.op != '-' {
+				bLen++
+			}
+		}
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, l := range lines[start:end] {
+			sb.WriteByte(l.op)
+			sb.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return sb.String()
+}
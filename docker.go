@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerTarget deploys into a container through the Docker Engine API,
+// with the same semantics as docker cp. To deploy into a named volume,
+// target a container that has the volume mounted.
+type dockerTarget struct {
+	ctx       context.Context // of the job, the Target methods don't take one
+	dest      string          // deploy path inside the container
+	container string
+	base      string // API base URL
+	client    *http.Client
+	fileMode  int64
+	dirMode   int64
+}
+
+var (
+	// Docker host -> client, shared by the targets so their
+	// idle connections are reused
+	dockerClients   = make(map[string]*http.Client)
+	dockerClientsMu sync.Mutex
+)
+
+// newDockerTarget returns the target of the job, whose requests
+// are cancelled with ctx.
+func newDockerTarget(ctx context.Context, j Job) (*dockerTarget, error) {
+	host := j.DockerHost
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	fm, dm, err := jobModes(j)
+	if err != nil {
+		return nil, err
+	}
+	t := &dockerTarget{ctx: ctx, dest: j.DeployPath, container: j.Container, fileMode: 0644, dirMode: 0755}
+	if fm != 0 {
+		t.fileMode, t.dirMode = int64(fm), int64(dm)
+	}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		t.base = "http://docker"
+	case strings.HasPrefix(host, "tcp://"):
+		// the daemon's TCP socket is unauthenticated without TLS
+		if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+			return nil, fmt.Errorf("docker host %v requires TLS, set $DOCKER_TLS_VERIFY and $DOCKER_CERT_PATH", host)
+		}
+		t.base = "https://" + strings.TrimPrefix(host, "tcp://")
+	default:
+		return nil, fmt.Errorf("unsupported docker host: %v", host)
+	}
+	if t.client, err = dockerClient(host); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// dockerClient returns the client for the Docker host, a unix://
+// socket or a tcp:// address reached over TLS with the certificates
+// in $DOCKER_CERT_PATH, like the docker CLI.
+func dockerClient(host string) (*http.Client, error) {
+	dockerClientsMu.Lock()
+	defer dockerClientsMu.Unlock()
+	if c, ok := dockerClients[host]; ok {
+		return c, nil
+	}
+	c := &http.Client{}
+	if sock, ok := strings.CutPrefix(host, "unix://"); ok {
+		c.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+	} else {
+		tc, err := dockerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		c.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tc}
+	}
+	dockerClients[host] = c
+	return c, nil
+}
+
+// dockerTLSConfig verifies the daemon with ca.pem and authenticates with
+// cert.pem and key.pem in $DOCKER_CERT_PATH, default ~/.docker.
+func dockerTLSConfig() (*tls.Config, error) {
+	dir := os.Getenv("DOCKER_CERT_PATH")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("docker TLS: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("docker TLS: no certificates in %v", filepath.Join(dir, "ca.pem"))
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("docker TLS: %v", err)
+	}
+	return &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func (t *dockerTarget) get(method, p string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(t.ctx, method, t.archiveURL(p), nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.client.Do(req)
+}
+
+func (t *dockerTarget) archiveURL(p string) string {
+	return fmt.Sprintf("%s/containers/%s/archive?path=%s", t.base, url.PathEscape(t.container), url.QueryEscape(p))
+}
+
+// Check verifies that the deploy path exists in the container.
+func (t *dockerTarget) Check() error {
+	resp, err := t.get("HEAD", t.dest)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("container %v path %v: %v", t.container, t.dest, resp.Status)
+	}
+	return nil
+}
+
+func (t *dockerTarget) Open(name string) (io.ReadCloser, error) {
+	resp, err := t.get("GET", path.Join(t.dest, name))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get archive: %v", resp.Status)
+	}
+
+	// the archive holds just the requested file
+	tr := tar.NewReader(resp.Body)
+	if _, err := tr.Next(); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, resp.Body}, nil
+}
+
+func (t *dockerTarget) Write(name string, b *bytes.Buffer) error {
+	// tar with the file and its parent directories,
+	// extracted relative to the deploy path
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	now := clock.Now()
+	dirs := strings.Split(path.Dir(name), "/")
+	for i := range dirs {
+		if dirs[i] == "." {
+			break
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     strings.Join(dirs[:i+1], "/") + "/",
+			Mode:     t.dirMode,
+			ModTime:  now,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     t.fileMode,
+		Size:     int64(b.Len()),
+		ModTime:  now,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, b); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(t.ctx, "PUT", t.archiveURL(t.dest), buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put archive: %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate
+// as cert.pem and key.pem to dir.
+func writeClientCert(t *testing.T, dir string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "deployer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+}
+
+func TestDockerTargetTCP(t *testing.T) {
+	var clientCerts int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCerts = len(r.TLS.PeerCertificates)
+		if r.URL.Path != "/containers/web/archive" || r.URL.Query().Get("path") != "/srv/www" {
+			http.NotFound(w, r)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	j := Job{Target: "docker", Container: "web", DeployPath: "/srv/www", DockerHost: "tcp://" + srv.Listener.Addr().String()}
+
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	if _, err := newDockerTarget(context.Background(), j); err == nil || !strings.Contains(err.Error(), "requires TLS") {
+		t.Fatalf("without TLS: got %v", err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644)
+	writeClientCert(t, dir)
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", dir)
+	dt, err := newDockerTarget(context.Background(), j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dockerClientsMu.Lock()
+		delete(dockerClients, j.DockerHost)
+		dockerClientsMu.Unlock()
+	})
+	if err := dt.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if clientCerts != 1 {
+		t.Fatalf("sent %d client certificates", clientCerts)
+	}
+}
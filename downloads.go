@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"sync"
+)
+
+var maxDownloads = flag.Int("max-downloads", 0, "max artifact downloads in flight across all jobs, others queue (default 0, unlimited)")
+
+var (
+	downloadSlots     chan struct{} // nil if unlimited
+	downloadSlotsOnce sync.Once
+)
+
+const (
+	downloadQueued  = "queued"
+	downloadRunning = "running"
+)
+
+// acquireDownload waits for a download slot, showing the job's download
+// state in /status, and returns the function releasing the slot.
+func acquireDownload(ctx context.Context, key string) (func(), error) {
+	downloadSlotsOnce.Do(func() {
+		if *maxDownloads > 0 {
+			downloadSlots = make(chan struct{}, *maxDownloads)
+		}
+	})
+	setDownload(key, downloadQueued)
+	if downloadSlots != nil {
+		select {
+		case downloadSlots <- struct{}{}:
+		default:
+			debugf("Job %v [%v]: %d downloads in flight, queued\n", key, requestID(ctx), *maxDownloads)
+			select {
+			case downloadSlots <- struct{}{}:
+			case <-ctx.Done():
+				setDownload(key, "")
+				return nil, ctx.Err()
+			}
+		}
+	}
+	setDownload(key, downloadRunning)
+	return func() {
+		if downloadSlots != nil {
+			<-downloadSlots
+		}
+		setDownload(key, "")
+	}, nil
+}
+
+// Downloads counts the artifact downloads across all jobs, see GET /downloads.
+type Downloads struct {
+	Max      int `json:"max"` // -max-downloads, 0 for unlimited
+	InFlight int `json:"inFlight"`
+	Queued   int `json:"queued"`
+}
+
+// countDownloads returns the downloads in flight and queued.
+func countDownloads() Downloads {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	d := Downloads{Max: *maxDownloads}
+	for _, s := range statuses {
+		switch s.Download {
+		case downloadRunning:
+			d.InFlight++
+		case downloadQueued:
+			d.Queued++
+		}
+	}
+	return d
+}
+
+func handleDownloads(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, countDownloads())
+}
+
+func setDownload(key, state string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	jobStatus(key).Download = state
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireDownload(t *testing.T) {
+	useState(t)
+	prev := downloadSlots
+	downloadSlotsOnce.Do(func() {})
+	downloadSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { downloadSlots = prev })
+
+	release, err := acquireDownload(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error)
+	go func() {
+		release, err := acquireDownload(context.Background(), "b")
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for countDownloads().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if d := countDownloads(); d.InFlight != 1 || d.Queued != 1 {
+		t.Fatalf("got %+v, want one in flight and one queued", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := acquireDownload(ctx, "c"); err != context.Canceled {
+		t.Fatalf("cancelled: got %v", err)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+	if d := countDownloads(); d.InFlight != 0 || d.Queued != 0 {
+		t.Fatalf("got %+v after the downloads", d)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/action-deployer/deploy"
+)
+
+// ExecContext is written as JSON to the stdin of the command of an
+// exec target, which deploys the files staged in Dir elsewhere.
+type ExecContext struct {
+	Job      string       `json:"job"`
+	Dir      string       `json:"dir"` // absolute deploy path holding the staged files
+	Artifact ExecArtifact `json:"artifact"`
+	Changes  []ExecChange `json:"changes"` // files written to Dir by this deploy
+}
+
+// ExecChange is a written file with the headers to upload it with, for
+// commands deploying to object storage, see objectMetadata.
+type ExecChange struct {
+	deploy.Change
+	CacheControl string `json:"cacheControl"`
+	ContentType  string `json:"contentType"`
+}
+
+type ExecArtifact struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Branch    string    `json:"branch"`
+	SHA       string    `json:"sha"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// runExecTarget runs the job's command on the files staged in its deploy
+// path. The command gets the path as its last argument and an ExecContext
+// on stdin, its output is logged, and a non-zero exit fails the deploy.
+func runExecTarget(ctx context.Context, j Job, key string, a *Artifact, changes []deploy.Change) error {
+	dir, err := filepath.Abs(j.DeployPath)
+	if err != nil {
+		return err
+	}
+	ecs := make([]ExecChange, 0, len(changes))
+	for _, c := range changes {
+		ec := ExecChange{Change: c}
+		ec.CacheControl, ec.ContentType = objectMetadata(j, c.Name)
+		ecs = append(ecs, ec)
+	}
+	in, err := json.Marshal(ExecContext{
+		Job: key,
+		Dir: dir,
+		Artifact: ExecArtifact{
+			ID:        a.ID,
+			Name:      a.Name,
+			Branch:    a.WorkflowRun.HeadBranch,
+			SHA:       a.WorkflowRun.HeadSHA,
+			CreatedAt: a.CreatedAt,
+		},
+		Changes: ecs,
+	})
+	if err != nil {
+		return err
+	}
+
+	args := append(j.Command[1:len(j.Command):len(j.Command)], dir)
+	cmd := exec.CommandContext(ctx, j.Command[0], args...)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(in)
+	if err := runLogged(ctx, key, cmd); err != nil {
+		return fmt.Errorf("command %v: %v", j.Command[0], err)
+	}
+	return nil
+}
+
+// runLogged runs cmd and logs its output, stdout and stderr
+// interleaved, line by line as the job's once it exited.
+func runLogged(ctx context.Context, key string, cmd *exec.Cmd) error {
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		log.Printf("[Info] Job %v [%v]: %v: %s\n", key, requestID(ctx), filepath.Base(cmd.Args[0]), sc.Bytes())
+	}
+	return err
+}
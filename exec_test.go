@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRunLogged(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	ctx := withRequestID(context.Background(), "req")
+
+	err := runLogged(ctx, "o.r.dist", exec.Command("sh", "-c", "echo out; echo err >&2; exit 3"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("got %v, want exit status 3", err)
+	}
+	for _, want := range []string{"[Info] Job o.r.dist [req]: sh: out\n", "[Info] Job o.r.dist [req]: sh: err\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log %q misses %q", buf.String(), want)
+		}
+	}
+}
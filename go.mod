@@ -2,4 +2,7 @@ module github.com/action-deployer
 
 go 1.22.4
 
-require github.com/twmb/murmur3 v1.1.8
+require (
+	github.com/twmb/murmur3 v1.1.8
+	gopkg.in/yaml.v3 v3.0.1
+)
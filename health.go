@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/action-deployer/deploy"
+)
+
+const (
+	defaultHealthTimeout  = time.Minute
+	defaultHealthInterval = 5 * time.Second
+)
+
+// HealthCheck is run after a deploy, it passes once URL answers with
+// a 2xx status or Command exits with 0. It's retried every Interval
+// until Timeout, then the deploy fails and, with Rollback, the snapshot
+// of the previous deploy is deployed again.
+type HealthCheck struct {
+	URL      string   `json:"url,omitempty"`
+	Command  []string `json:"command,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`  // default 1m
+	Interval Duration `json:"interval,omitempty"` // default 5s
+	Rollback bool     `json:"rollback,omitempty"`
+}
+
+func validateHealthCheck(j Job) error {
+	hc := j.HealthCheck
+	if hc == nil {
+		return nil
+	}
+	switch {
+	case (hc.URL == "") == (len(hc.Command) == 0):
+		return errors.New("healthCheck requires either url or command")
+	case hc.Timeout.Duration < 0 || hc.Interval.Duration < 0:
+		return errors.New("healthCheck timeout or interval is negative")
+	case j.SnapshotOnly:
+		return errors.New("healthCheck is not supported with snapshotOnly")
+	case hc.Rollback && j.SnapshotPath == "":
+		return errors.New("healthCheck rollback requires snapshotPath")
+	case hc.Rollback && (isTemplate(j.DeployPath) || j.CleanupPreviews):
+		return errors.New("healthCheck rollback is not supported with deployPath placeholders")
+	}
+	return nil
+}
+
+// checkHealth runs the job's health check until it passes or times out.
+func checkHealth(ctx context.Context, j Job, key string) error {
+	hc := j.HealthCheck
+	timeout, interval := defaultHealthTimeout, defaultHealthInterval
+	if hc.Timeout.Duration > 0 {
+		timeout = hc.Timeout.Duration
+	}
+	if hc.Interval.Duration > 0 {
+		interval = hc.Interval.Duration
+	}
+	deadline := clock.Now().Add(timeout)
+	for {
+		err := probe(ctx, hc, interval)
+		if err == nil {
+			log.Printf("[Info] Job %v [%v]: health check passed\n", key, requestID(ctx))
+			return nil
+		}
+		debugf("Job %v [%v]: health check: %v\n", key, requestID(ctx), err)
+		if !clock.Now().Add(interval).Before(deadline) {
+			return fmt.Errorf("health check failed after %v: %v", timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(interval):
+		}
+	}
+}
+
+// probe runs the health check once, giving up after timeout.
+func probe(ctx context.Context, hc *HealthCheck, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if hc.URL == "" {
+		out, err := exec.CommandContext(ctx, hc.Command[0], hc.Command[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("command %v: %v: %s", hc.Command[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v: %v", hc.URL, resp.Status)
+	}
+	return nil
+}
+
+// unhealthy reports whether artifact id failed its health check.
+func unhealthy(key string, id int64) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	r, ok := records[key]
+	return ok && r.Unhealthy == id
+}
+
+// failHealthCheck records that an artifact failed its health check, so
+// it isn't deployed again, also after a restart, and rolls back if the
+// job does. written holds the files the failed deploy wrote by deploy
+// path. It returns the error failing the deploy.
+func failHealthCheck(ctx context.Context, j Job, key string, a *Artifact, written map[string][]string, err error) error {
+	stateMu.Lock()
+	jobRecord(key).Unhealthy = a.ID
+	serr := saveRecords(key)
+	stateMu.Unlock()
+	if serr != nil {
+		log.Printf("[Error] Job %v [%v]: save unhealthy artifact %v: %v\n", key, requestID(ctx), a.ID, serr)
+	}
+	if !j.HealthCheck.Rollback {
+		return err
+	}
+	log.Printf("[Error] Job %v [%v]: artifact %v: %v, rolling back\n", key, requestID(ctx), a.ID, err)
+	prev, rerr := rollback(ctx, j, key, written)
+	if rerr != nil {
+		return fmt.Errorf("%v; rollback failed: %v", err, rerr)
+	}
+	return fmt.Errorf("%v; rolled back to artifact %v", err, prev.ArtifactID)
+}
+
+// rollback deploys the snapshot of the last successful deploy to every
+// target, removes the files of written the snapshot doesn't deploy, and
+// returns that deploy.
+func rollback(ctx context.Context, j Job, key string, written map[string][]string) (*Deploy, error) {
+	prev := lastDeploy(key)
+	if prev == nil || prev.Snapshot == "" {
+		return nil, errors.New("no snapshot of a previous deploy")
+	}
+	filename, err := snapshotZip(prev.Snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %v: %v", prev.Snapshot, err)
+	}
+	defer os.Remove(filename)
+
+	a := &Artifact{
+		ID:          prev.ArtifactID,
+		Name:        j.ArtifactName,
+		CreatedAt:   prev.CreatedAt,
+		WorkflowRun: WorkflowRun{HeadSHA: prev.SHA},
+	}
+	var errs []error
+	for _, tj := range destinations(j) {
+		// diff every file, the failed deploy changed them
+		tj.SkipUnchangedDirs = false
+		if _, err := deployTarget(ctx, tj, key, filename, a); err != nil {
+			errs = append(errs, fmt.Errorf("target %v: %v", tj.DeployPath, err))
+			continue
+		}
+		if err := removeAdded(ctx, tj, key, filename, written[tj.DeployPath]); err != nil {
+			errs = append(errs, fmt.Errorf("target %v: %v", tj.DeployPath, err))
+		}
+	}
+	return prev, errors.Join(errs...)
+}
+
+// removeAdded removes the files of written that the snapshot at
+// filename doesn't deploy to the job's deploy path, those the failed
+// deploy added. Files in Docker containers stay.
+func removeAdded(ctx context.Context, j Job, key, filename string, written []string) error {
+	if len(written) == 0 {
+		return nil
+	}
+	if j.Target == "docker" {
+		log.Printf("[Warn] Job %v [%v]: files added to container %v by the failed deploy aren't removed\n", key, requestID(ctx), j.Container)
+		return nil
+	}
+	opts, err := extractOptions(ctx, j)
+	if err != nil {
+		return err
+	}
+	names, err := deploy.DeployedNames(ctx, filename, opts)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	var removed int
+	for _, name := range written {
+		if keep[name] {
+			continue
+		}
+		path := filepath.Join(j.DeployPath, filepath.FromSlash(name))
+		if !within(path, j.DeployPath) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("[Info] Job %v [%v]: %v: removed %d files added by the failed deploy\n", key, requestID(ctx), j.DeployPath, removed)
+	}
+	return nil
+}
+
+// snapshotZip repacks a snapshot tarball as a zip in tempDir,
+// to be extracted like a downloaded artifact.
+func snapshotZip(snapshot string) (string, error) {
+	in, err := os.Open(snapshot)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(gr)
+
+	f, err := os.CreateTemp(tempDir, "rollback-*.zip")
+	if err != nil {
+		return "", err
+	}
+	zw := zip.NewWriter(f)
+	err = func() error {
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: h.Name, Method: zip.Deflate, Modified: h.ModTime})
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, tr); err != nil {
+				return err
+			}
+		}
+	}()
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeArtifact writes a zip holding files by name in the temp dir.
+func writeArtifact(t *testing.T, files map[string]string) string {
+	t.Helper()
+	f, err := os.CreateTemp(tempDir, "artifact-*.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestRollbackRemovesAdded(t *testing.T) {
+	useWorkDir(t)
+	useFakeClock(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", DeployPath: t.TempDir(), SnapshotPath: t.TempDir(),
+		HealthCheck: &HealthCheck{URL: "http://127.0.0.1/healthz", Rollback: true}}
+	key := jobKey(j)
+	useState(t, j)
+	ctx := context.Background()
+
+	good := &Artifact{ID: 1, CreatedAt: time.Unix(1, 0).UTC()}
+	filename := writeArtifact(t, map[string]string{"index.html": "v1"})
+	if _, err := deployTarget(ctx, j, key, filename, good); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := writeSnapshot(ctx, j, filename, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordDeploy(key, Deploy{ArtifactID: good.ID, CreatedAt: good.CreatedAt, Snapshot: snapshot}); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := &Artifact{ID: 2, CreatedAt: time.Unix(2, 0).UTC()}
+	r, err := deployTarget(ctx, j, key, writeArtifact(t, map[string]string{"index.html": "v2", "new.js": "new"}), bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = failHealthCheck(ctx, j, key, bad, map[string][]string{j.DeployPath: r.Changed}, os.ErrDeadlineExceeded)
+	if err == nil {
+		t.Fatal("failed health check: got no error")
+	}
+
+	if b, err := os.ReadFile(filepath.Join(j.DeployPath, "index.html")); string(b) != "v1" {
+		t.Errorf("index.html holds %q, %v after the rollback", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(j.DeployPath, "new.js")); !os.IsNotExist(err) {
+		t.Errorf("new.js kept after the rollback: %v", err)
+	}
+
+	// the next instance doesn't deploy it again
+	if err := reloadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !unhealthy(key, bad.ID) {
+		t.Error("unhealthy artifact forgotten after reloading the state")
+	}
+}
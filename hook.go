@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/action-deployer/deploy"
+)
+
+func validateHook(j Job) error {
+	if len(j.PostDeploy) == 0 {
+		if len(j.HookFiles) > 0 || len(j.HookRewrite) > 0 {
+			return errors.New("hookFiles and hookRewrite require postDeploy")
+		}
+		return nil
+	}
+	if _, err := exec.LookPath(j.PostDeploy[0]); err != nil {
+		return fmt.Errorf("postDeploy: %v", err)
+	}
+	if err := validateExcludes(j.HookFiles); err != nil {
+		return fmt.Errorf("hookFiles: %v", err)
+	}
+	for _, rw := range j.HookRewrite {
+		if _, err := regexp.Compile(rw.Match); err != nil {
+			return fmt.Errorf("invalid hookRewrite %q: %v", rw.Match, err)
+		}
+	}
+	return nil
+}
+
+// hookChanges returns the changed files the job's hook is told about:
+// those matching HookFiles, if set, renamed by HookRewrite, without
+// the ones renamed to an empty name.
+func hookChanges(j Job, changed []string) []string {
+	res := make([]string, 0, len(changed))
+	rws := make([]*regexp.Regexp, len(j.HookRewrite))
+	for i, rw := range j.HookRewrite {
+		rws[i] = regexp.MustCompile(rw.Match) // checked by validateHook
+	}
+	for _, name := range changed {
+		name = filepath.ToSlash(name)
+		if len(j.HookFiles) > 0 && !deploy.PathMatches(name, j.HookFiles) {
+			continue
+		}
+		for i, re := range rws {
+			name = re.ReplaceAllString(name, j.HookRewrite[i].Replace)
+		}
+		if name != "" {
+			res = append(res, name)
+		}
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// runHook runs the job's PostDeploy command after a successful deploy
+// of a. The names of the changed files, as filtered by hookChanges, are
+// written one per line to a temp file named by $DEPLOYER_CHANGED_FILES.
+func runHook(ctx context.Context, j Job, key string, a *Artifact, changed []string) error {
+	f, err := os.CreateTemp(tempDir, "changed-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	changes := hookChanges(j, changed)
+	for _, name := range changes {
+		fmt.Fprintln(f, name)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	list, err := filepath.Abs(f.Name())
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, j.PostDeploy[0], j.PostDeploy[1:]...)
+	cmd.Env = append(os.Environ(),
+		"DEPLOYER_JOB="+key,
+		"DEPLOYER_ARTIFACT_ID="+strconv.FormatInt(a.ID, 10),
+		"DEPLOYER_SHA="+a.WorkflowRun.HeadSHA,
+		"DEPLOYER_DEPLOY_PATH="+j.DeployPath,
+		"DEPLOYER_CHANGED_FILES="+list,
+		"DEPLOYER_CHANGED_COUNT="+strconv.Itoa(len(changes)),
+	)
+	if err := runLogged(ctx, key, cmd); err != nil {
+		return fmt.Errorf("post-deploy hook %v: %v", strings.Join(j.PostDeploy, " "), err)
+	}
+	debugf("Job %v [%v]: post-deploy hook ran with %d changed files\n", key, requestID(ctx), len(changes))
+	return nil
+}
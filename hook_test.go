@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestValidateHook(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		hook []string
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"in PATH", []string{"sh", "-c", "true"}, true},
+		{"missing", []string{"deployer-no-such-hook"}, false},
+		{"missing path", []string{"/nonexistent/purge.sh"}, false},
+	} {
+		err := validateHook(Job{PostDeploy: c.hook})
+		if (err == nil) != c.ok {
+			t.Errorf("%v: got %v", c.name, err)
+		}
+	}
+}
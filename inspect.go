@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/action-deployer/deploy"
+)
+
+type ZipReport struct {
+	File    string         `json:"file"`
+	Job     string         `json:"job,omitempty"` // whose filters were applied
+	Entries []deploy.Entry `json:"entries"`
+}
+
+// runValidateZip lists the entries of a zip and what a deploy would do
+// with them, without deploying. arg is a zip file, or a job key for its
+// last downloaded artifact. The filters of the job with key, or of the
+// job of arg, are applied, none without a job.
+func runValidateZip(arg, key string) bool {
+	if arg == "" {
+		fmt.Fprintln(os.Stderr, "usage: validate-zip <zip file or job> [job]")
+		return false
+	}
+	filename := arg
+	if key == "" && findJob(arg) != nil {
+		key = arg
+		filename = filepath.Join(artifactsDir, arg+".zip")
+	}
+	var opts deploy.Options
+	if key != "" {
+		j := findJob(key)
+		if j == nil {
+			fmt.Fprintf(os.Stderr, "unknown job: %v\n", key)
+			return false
+		}
+		var err error
+		if opts, err = extractOptions(context.Background(), *j); err != nil {
+			fmt.Fprintf(os.Stderr, "job %v: %v\n", key, err)
+			return false
+		}
+	}
+	if err := checkZip(filename); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", filename, err)
+		return false
+	}
+	es, err := deploy.Inspect(filename, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", filename, err)
+		return false
+	}
+
+	rep := ZipReport{File: filename, Job: key, Entries: es}
+	ok := true
+	for _, e := range es {
+		if e.Error != "" {
+			ok = false
+		}
+	}
+	printResult(rep, func() {
+		var deployed, skipped, failed int
+		for _, e := range es {
+			fmt.Printf("%v %10d %10d %08x %v", e.Mode, e.Size, e.CompressedSize, e.CRC32, e.Name)
+			if e.Symlink {
+				fmt.Print(" (symlink, extracted as a file)")
+			}
+			switch {
+			case e.Error != "":
+				fmt.Printf("  error: %v", e.Error)
+				failed++
+			case e.Skip != "":
+				fmt.Printf("  skipped: %v", e.Skip)
+				skipped++
+			default:
+				if e.Dest != e.Name {
+					fmt.Printf(" -> %v", e.Dest)
+				}
+				deployed++
+			}
+			fmt.Println()
+		}
+		fmt.Printf("%d entries: %d deployed, %d skipped, %d errors\n", len(es), deployed, skipped, failed)
+	})
+	return ok
+}
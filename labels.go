@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// NameLabels selects artifacts by the key=value labels in their names,
+// e.g. site--env=prod--v=1.2.3 with Delimiter "--", where the first
+// segment is the job's ArtifactName and the others are labels.
+type NameLabels struct {
+	Delimiter string            `json:"delimiter,omitempty"` // default "--"
+	Match     map[string]string `json:"match"`               // label -> glob its value must match
+}
+
+const defaultLabelDelimiter = "--"
+
+func (l *NameLabels) delimiter() string {
+	if l.Delimiter == "" {
+		return defaultLabelDelimiter
+	}
+	return l.Delimiter
+}
+
+func validateNameLabels(j Job) error {
+	l := j.NameLabels
+	if l == nil {
+		return nil
+	}
+	switch {
+	case j.Source == "release":
+		return errors.New("nameLabels only applies to artifacts")
+	case len(l.Match) == 0:
+		return errors.New("nameLabels match is empty")
+	case strings.Contains(l.delimiter(), "="):
+		return errors.New("nameLabels delimiter must not contain =")
+	case strings.Contains(j.ArtifactName, l.delimiter()):
+		return errors.New("artifactName must not contain the nameLabels delimiter")
+	}
+	for k, v := range l.Match {
+		// artifact names can't contain slashes, and the job key ends up in file names
+		if k == "" || strings.Contains(k, l.delimiter()) || strings.ContainsAny(k+v, "/\\") {
+			return fmt.Errorf("invalid nameLabels label %q", k+"="+v)
+		}
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid nameLabels pattern %q: %v", v, err)
+		}
+	}
+	return nil
+}
+
+// labelsMatch reports whether the artifact name is the job's ArtifactName
+// followed by labels matching every filter of its NameLabels.
+func (j Job) labelsMatch(name string) bool {
+	l := j.NameLabels
+	segments := strings.Split(name, l.delimiter())
+	if !j.nameMatches(segments[0]) {
+		return false
+	}
+	labels := make(map[string]string)
+	for _, s := range segments[1:] {
+		if k, v, ok := strings.Cut(s, "="); ok {
+			labels[k] = v
+		}
+	}
+	for k, pattern := range l.Match {
+		v, ok := labels[k]
+		if !ok {
+			return false
+		}
+		if ok, _ := path.Match(pattern, v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// labelsKey returns the suffix of the job key for its label filters,
+// e.g. "--env=prod", so jobs selecting different labels of the same
+// artifact name have their own state.
+func (l *NameLabels) labelsKey() string {
+	keys := make([]string, 0, len(l.Match))
+	for k := range l.Match {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%v%v=%v", l.delimiter(), k, l.Match[k])
+	}
+	return sb.String()
+}
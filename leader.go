@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	leaderElect   = flag.Bool("leader-elect", false, "only run jobs while holding a Kubernetes Lease, for running several replicas")
+	leaderLease   = flag.String("leader-lease", "action-deployer", "name of the Lease, or namespace/name, default in the pod's namespace")
+	leaseDuration = flag.Duration("leader-lease-duration", 15*time.Second, "how long a Lease is held without renewal before another replica takes over")
+)
+
+// leaderLock is a lock held by at most one replica at a time.
+type leaderLock interface {
+	// tryAcquire acquires or renews the lock for id, to expire after
+	// ttl without renewal, and reports whether id holds it.
+	tryAcquire(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	// release gives up the lock if id holds it.
+	release(ctx context.Context, id string) error
+}
+
+// elector keeps track of whether this replica is the leader. Jobs run
+// with the context of the current term, cancelled once it's lost.
+type elector struct {
+	lock leaderLock
+	id   string
+
+	mu     sync.Mutex
+	term   context.Context // nil while not leading
+	cancel context.CancelFunc
+}
+
+var leader *elector // nil without -leader-elect
+
+func newElector() (*elector, error) {
+	l, err := newLeaseLock(*leaderLease)
+	if err != nil {
+		return nil, err
+	}
+	id := os.Getenv("POD_NAME")
+	if id == "" {
+		if id, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &elector{lock: l, id: id}, nil
+}
+
+// run acquires and renews the lock until ctx is done, then releases it.
+func (e *elector) run(ctx context.Context) {
+	t := clock.NewTicker(*leaseDuration / 3)
+	defer t.Stop()
+	for {
+		e.renew(ctx)
+		select {
+		case <-ctx.Done():
+			e.step(false)
+			rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := e.lock.release(rctx, e.id); err != nil {
+				log.Printf("[Warn] Leader election: release: %v\n", err)
+			}
+			cancel()
+			return
+		case <-t.C():
+		}
+	}
+}
+
+func (e *elector) renew(ctx context.Context) {
+	rctx, cancel := context.WithTimeout(ctx, *leaseDuration/3)
+	defer cancel()
+	ok, err := e.lock.tryAcquire(rctx, e.id, *leaseDuration)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[Warn] Leader election: %v\n", err)
+		// the lease may expire before it can be renewed
+		// again, another replica could be leading by then
+		ok = false
+	}
+	e.step(ok)
+}
+
+// step starts or ends a term.
+func (e *elector) step(leading bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case leading && e.term == nil:
+		log.Printf("[Info] Leader election: %v is the leader\n", e.id)
+		// the previous leader may have deployed since the state was loaded
+		if err := reloadState(); err != nil {
+			log.Printf("[Error] Leader election: reload state: %v\n", err)
+		}
+		e.term, e.cancel = context.WithCancel(context.Background())
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	case !leading && e.term != nil:
+		log.Printf("[Warn] Leader election: %v is no longer the leader, stopping jobs\n", e.id)
+		e.cancel()
+		e.term, e.cancel = nil, nil
+	}
+}
+
+// leading returns the context of the current term, or false
+// if this replica isn't the leader.
+func (e *elector) leading() (context.Context, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.term, e.term != nil
+}
+
+// reloadState replaces the state in memory with the one on disk.
+func reloadState() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	lastUpdate = make(map[string]time.Time)
+	if err := loadProfiled(logFile, lastUpdate); err != nil {
+		return err
+	}
+	if err := loadRecords(); err != nil {
+		return err
+	}
+	if *perJobState {
+		return loadJobStates()
+	}
+	return nil
+}
+
+// leaseLock is a Kubernetes coordination.k8s.io/v1 Lease, accessed with
+// the pod's service account, which needs get, create and update on it.
+type leaseLock struct {
+	client    *http.Client
+	url       string // of the Lease
+	namespace string
+	name      string
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// microTime is the format of the times of a Lease.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func newLeaseLock(ref string) (*leaseLock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("-leader-elect needs to run in Kubernetes, $KUBERNETES_SERVICE_HOST is not set")
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		b, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("namespace of the Lease: %v", err)
+		}
+		namespace, name = strings.TrimSpace(string(b)), ref
+	}
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid -leader-lease %q", ref)
+	}
+	pem, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in the service account CA")
+	}
+	return &leaseLock{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:       fmt.Sprintf("https://%v/apis/coordination.k8s.io/v1/namespaces/%v/leases/%v", net.JoinHostPort(host, port), namespace, name),
+		namespace: namespace,
+		name:      name,
+	}, nil
+}
+
+func (l *leaseLock) tryAcquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	cur, err := l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := clock.Now()
+	if cur == nil {
+		var le lease
+		le.APIVersion, le.Kind = "coordination.k8s.io/v1", "Lease"
+		le.Metadata.Name, le.Metadata.Namespace = l.name, l.namespace
+		le.Spec.HolderIdentity = id
+		le.Spec.LeaseDurationSeconds = int(ttl / time.Second)
+		le.Spec.AcquireTime = now.UTC().Format(microTime)
+		le.Spec.RenewTime = le.Spec.AcquireTime
+		return l.write(ctx, "POST", strings.TrimSuffix(l.url, "/"+l.name), &le)
+	}
+
+	if cur.Spec.HolderIdentity != id && cur.Spec.HolderIdentity != "" {
+		renewed, err := time.Parse(microTime, cur.Spec.RenewTime)
+		if err == nil && now.Before(renewed.Add(time.Duration(cur.Spec.LeaseDurationSeconds)*time.Second)) {
+			return false, nil
+		}
+	}
+	if cur.Spec.HolderIdentity != id {
+		cur.Spec.HolderIdentity = id
+		cur.Spec.AcquireTime = now.UTC().Format(microTime)
+		cur.Spec.LeaseTransitions++
+	}
+	cur.Spec.LeaseDurationSeconds = int(ttl / time.Second)
+	cur.Spec.RenewTime = now.UTC().Format(microTime)
+	// fails with a conflict if another replica updated it meanwhile
+	return l.write(ctx, "PUT", l.url, cur)
+}
+
+func (l *leaseLock) release(ctx context.Context, id string) error {
+	cur, err := l.get(ctx)
+	if err != nil || cur == nil || cur.Spec.HolderIdentity != id {
+		return err
+	}
+	cur.Spec.HolderIdentity = ""
+	_, err = l.write(ctx, "PUT", l.url, cur)
+	return err
+}
+
+// get returns the Lease, or nil if it doesn't exist.
+func (l *leaseLock) get(ctx context.Context) (*lease, error) {
+	resp, err := l.do(ctx, "GET", l.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("get lease %v/%v: %v", l.namespace, l.name, resp.Status)
+	}
+	le := new(lease)
+	if err := json.NewDecoder(resp.Body).Decode(le); err != nil {
+		return nil, err
+	}
+	return le, nil
+}
+
+// write creates or updates the Lease and reports whether it was
+// written, false if another replica got there first.
+func (l *leaseLock) write(ctx context.Context, method, url string, le *lease) (bool, error) {
+	b, err := json.Marshal(le)
+	if err != nil {
+		return false, err
+	}
+	resp, err := l.do(ctx, method, url, b)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, fmt.Errorf("write lease %v/%v: %v", l.namespace, l.name, resp.Status)
+}
+
+func (l *leaseLock) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// projected tokens are rotated, read it every time
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", *userAgent)
+	return l.client.Do(req)
+}
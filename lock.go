@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errLocked means another process holds the lock.
+var errLocked = errors.New("locked")
+
+// lockFile is the open pidfile, held until releaseLock.
+var lockFile *os.File
+
+// acquireLock locks a pidfile at path so that only one instance
+// runs against the same state directory. The lock is held while the
+// file is open and released by the OS when the process exits, so a
+// pidfile left behind by a crash is simply locked again.
+func acquireLock(path string) error {
+	f, err := openLock(path)
+	if errors.Is(err, errLocked) {
+		b, _ := os.ReadFile(path)
+		return fmt.Errorf("another instance is already running (pid %v, lock %v)", strings.TrimSpace(string(b)), path)
+	}
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	if pid := strings.TrimSpace(string(b[:n])); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		log.Printf("[Info] Reclaiming stale lock of pid %v: %v\n", pid, path)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return err
+	}
+	lockFile = f
+	return nil
+}
+
+// releaseLock removes the pidfile, before closing it so that
+// no other instance locks the removed file.
+func releaseLock(path string) {
+	if lockFile == nil {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[Error] Release lock: %v\n", err)
+	}
+	lockFile.Close()
+	lockFile = nil
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// openLock creates the pidfile at path, or fails with errLocked while
+// another process holds it. The file is kept open, which on Windows
+// keeps others from removing it, so only a pidfile left behind by a
+// process that exited is removed and created again.
+func openLock(path string) (*os.File, error) {
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errLocked
+		}
+	}
+	return nil, errLocked
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deployer.pid")
+	// left behind by a crashed instance
+	if err := os.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := acquireLock(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("pidfile holds %q, %v", b, err)
+	}
+
+	if f, err := openLock(path); !errors.Is(err, errLocked) {
+		f.Close()
+		t.Fatalf("second lock: got %v, want errLocked", err)
+	}
+	if err := acquireLock(path); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("second instance: got %v", err)
+	}
+
+	releaseLock(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("pidfile left after release: %v", err)
+	}
+	f, err := openLock(path)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	f.Close()
+}
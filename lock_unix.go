@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openLock opens and flocks the pidfile at path, or fails with
+// errLocked while another process holds it.
+func openLock(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, errLocked
+			}
+			return nil, err
+		}
+
+		// the previous holder may have removed the file
+		// between our open and lock, lock the new one then
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if pi, err := os.Stat(path); err == nil && os.SameFile(fi, pi) {
+			return f, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			f.Close()
+			return nil, err
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	logPath    = flag.String("log-file", "", "write logs to this file instead of stderr")
+	logMaxSize = flag.Uint64("log-max-size", 100, "rotate the log file once it reaches this size in MiB, 0 to disable")
+	logMaxAge  = flag.Duration("log-max-age", 0, "rotate the log file once it is this old, 0 to disable")
+	logKeep    = flag.Int("log-keep", 5, "rotated log files to keep")
+)
+
+// rotatingFile is a log file that is rotated to <path>.1, <path>.2, ...
+// by size and age, keeping the newest files.
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	size   uint64
+	opened time.Time
+}
+
+func openLogFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, uint64(fi.Size()), clock.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		full := *logMaxSize > 0 && r.size > 0 && r.size+uint64(len(p)) > *logMaxSize<<20
+		old := *logMaxAge > 0 && clock.Now().Sub(r.opened) > *logMaxAge
+		if full || old {
+			if err := r.rotate(); err != nil {
+				fmt.Fprintf(os.Stderr, "[Error] Rotate log file: %v\n", err)
+			}
+		}
+	}
+	if r.f == nil {
+		// closed by a failed rotation, log to stderr until it reopens
+		if err := r.open(); err != nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += uint64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, dropping the oldest, and reopens the
+// log. If it fails, the log may be left closed with r.f nil.
+// The caller must hold r.mu.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.path, *logKeep))
+	for i := *logKeep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if *logKeep > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileAge(t *testing.T) {
+	c := useFakeClock(t)
+	prev := *logMaxAge
+	*logMaxAge = time.Hour
+	t.Cleanup(func() { *logMaxAge = prev })
+	path := filepath.Join(t.TempDir(), "deployer.log")
+	r, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.f.Close() })
+
+	r.Write([]byte("first\n"))
+	c.Advance(59 * time.Minute)
+	r.Write([]byte("second\n"))
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("rotated before the max age: %v", err)
+	}
+	c.Advance(2 * time.Minute)
+	r.Write([]byte("third\n"))
+	if b, err := os.ReadFile(path + ".1"); string(b) != "first\nsecond\n" {
+		t.Fatalf("rotated file holds %q, %v", b, err)
+	}
+	if b, err := os.ReadFile(path); string(b) != "third\n" {
+		t.Fatalf("log holds %q, %v", b, err)
+	}
+}
+
+func TestRotatingFileFailedRotation(t *testing.T) {
+	c := useFakeClock(t)
+	prev := *logMaxAge
+	*logMaxAge = time.Hour
+	t.Cleanup(func() { *logMaxAge = prev })
+	dir := filepath.Join(t.TempDir(), "log")
+	os.Mkdir(dir, 0755)
+	path := filepath.Join(dir, "deployer.log")
+	r, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the log can't be rotated nor reopened
+	os.RemoveAll(dir)
+	c.Advance(2 * time.Hour)
+	if n, err := r.Write([]byte("to stderr\n")); n != 10 || err != nil {
+		t.Fatalf("write after a failed rotation: %d, %v", n, err)
+	}
+	if r.f != nil {
+		t.Fatal("log file still open after a failed rotation")
+	}
+
+	os.Mkdir(dir, 0755)
+	if _, err := r.Write([]byte("back\n")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.f.Close() })
+	if b, err := os.ReadFile(path); string(b) != "back\n" {
+		t.Fatalf("reopened log holds %q, %v", b, err)
+	}
+}
@@ -1,35 +1,287 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/twmb/murmur3"
+	"github.com/action-deployer/deploy"
 )
 
 type Secret struct {
-	Owner string `json:"owner"`
-	Token string `json:"token"`
+	Owner  string `json:"owner"`
+	Repo   string `json:"repo,omitempty"` // optional, for tokens scoped to a single repo
+	Token  string `json:"token"`
+	APIURL string `json:"apiUrl,omitempty"` // e.g. https://github.example.com/api/v3, default https://api.github.com
+
+	// Instead of Token, a command printing the token or the Unix socket
+	// of an agent answering with it, asked again after TokenTTL
+	TokenCommand []string `json:"tokenCommand,omitempty"`
+	TokenSocket  string   `json:"tokenSocket,omitempty"`
+	TokenTTL     Duration `json:"tokenTtl,omitempty"` // default 5m
 }
 
 type Job struct {
-	Owner        string   `json:"owner"`
-	Repo         string   `json:"repo"`
-	ArtifactName string   `json:"artifactName"`
-	Excludes     []string `json:"excludes"`
-	DeployPath   string   `json:"deployPath"`
+	Owner        string `json:"owner"`
+	Repo         string `json:"repo"`
+	ArtifactName string `json:"artifactName"`
+	Workflow     string `json:"workflow,omitempty"` // workflow file name, path or name
+	Branch       string `json:"branch,omitempty"`   // only deploy artifacts built from this branch
+	APIURL       string `json:"apiUrl,omitempty"`   // GitHub API of the repo, default the one of its secret
+
+	// Match ArtifactName ignoring case, for builds naming it inconsistently
+	CaseInsensitiveName bool `json:"caseInsensitiveName,omitempty"`
+
+	// Select the artifacts named ArtifactName followed by labels, instead
+	// of exactly ArtifactName, by the values of those labels
+	NameLabels *NameLabels `json:"nameLabels,omitempty"`
+
+	// Only deploy artifacts of runs triggered by one of these logins
+	AllowedActors []string `json:"allowedActors,omitempty"`
+	TieBreaker    string   `json:"tieBreaker,omitempty"` // "id" (default) or "run", for artifacts created at the same time
+
+	// Pages of 100 artifacts, newest first, to scan for a match before
+	// giving up, default 10
+	MaxPages int `json:"maxPages,omitempty"`
+
+	// Where to get the archive from: "artifact" (default) or "release" for
+	// an asset matching ArtifactName of the latest release, or the one of Tag
+	Source string `json:"source,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+
+	// Hold the job at the artifact with this id, or the newest one built
+	// from a commit starting with this SHA, instead of the latest
+	PinArtifact int64  `json:"pinArtifact,omitempty"`
+	PinSHA      string `json:"pinSha,omitempty"`
+
+	// How "no artifact found" is logged: "error" (default), "warn" or
+	// "debug", and whether it fails the job, by default only for "error"
+	OnMissing        string   `json:"onMissing,omitempty"`
+	MissingIsFailure *bool    `json:"missingIsFailure,omitempty"`
+	Excludes         []string `json:"excludes"`
+	DeployPath       string   `json:"deployPath"`
+
+	// Poll less often after consecutive runs without an artifact,
+	// doubling the interval up to this
+	MissingBackoff Duration `json:"missingBackoff,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"` // e.g. team: web, shown in logs and /status
+
+	// Deploy the artifact to several targets instead of DeployPath. By
+	// default lastUpdate only advances once every target succeeded.
+	Targets          []Destination `json:"targets,omitempty"`
+	AdvanceOnPartial bool          `json:"advanceOnPartial,omitempty"`
+
+	// Ordered groups of patterns like Excludes, matched against the names
+	// in DeployPath. Other files are extracted first, then each phase in
+	// order, e.g. [["assets/.*"], [".*\\.html"]] for the HTML last
+	Phases [][]string `json:"phases,omitempty"`
+
+	// Content filters, applied on top of Excludes
+	SkipBinary   bool     `json:"skipBinary,omitempty"`   // skip files that look binary
+	AllowedTypes []string `json:"allowedTypes,omitempty"` // MIME types by extension, e.g. "text/*"
+
+	// Size limits in bytes, 0 means unlimited
+	MaxFileSize    uint64 `json:"maxFileSize,omitempty"`
+	MaxArchiveSize uint64 `json:"maxArchiveSize,omitempty"`
+	OnOversize     string `json:"onOversize,omitempty"` // "skip" (default) or "fail" for files over MaxFileSize
+
+	// Zip entry of the artifact to deploy the contents of instead, e.g.
+	// "site.zip", with "!" separating the names of nested ones
+	InnerArchive string `json:"innerArchive,omitempty"`
+
+	// Only deploy files with these extensions, "skip" (default)
+	// or "fail" on others
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	OnDisallowed      string   `json:"onDisallowed,omitempty"`
+
+	// Files in DeployPath that can't be written: "skip", "fail"
+	// or "force", logged as errors by default
+	OnPermissionDenied string `json:"onPermissionDenied,omitempty"`
+
+	// Skip top-level directories whose files are the same as in the last
+	// deploy according to the zip headers, instead of diffing every file
+	SkipUnchangedDirs bool `json:"skipUnchangedDirs,omitempty"`
+
+	// Strip the top-level directory of the artifact if it holds every file
+	StripRoot bool `json:"stripRoot,omitempty"`
+
+	// Rules rewriting the names of extracted files, applied in order
+	Rewrite []PathRewrite `json:"rewrite,omitempty"`
+
+	// Maximum uncompressed:compressed ratio of any entry, 0 means unlimited
+	MaxCompressionRatio float64 `json:"maxCompressionRatio,omitempty"`
+
+	// Refuse to deploy an artifact with this many percent fewer files
+	// or bytes than the previous deploy, 0 disables the check
+	MaxShrinkPercent float64 `json:"maxShrinkPercent,omitempty"`
+
+	// Refuse to deploy an artifact with fewer files than this
+	MinFiles int `json:"minFiles,omitempty"`
+
+	// Only deploy within these windows, in Timezone (default local time),
+	// new artifacts outside them are deployed once a window opens
+	Windows  []Window `json:"windows,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+
+	// Abort a run taking longer than this, 0 means no limit
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Defer deploying a new artifact until it has been the latest for this long
+	Settle Duration `json:"settle,omitempty"`
+
+	// Defer deploying until this long after the previous deploy,
+	// the then latest artifact is deployed
+	MinDeployInterval Duration `json:"minDeployInterval,omitempty"`
+
+	// Only deploy a new artifact once it's approved via /approve
+	RequireApproval bool `json:"requireApproval,omitempty"`
+
+	// Refuse to deploy artifacts without a valid build provenance
+	// attestation from this repo, requires the gh CLI
+	VerifyAttestation bool `json:"verifyAttestation,omitempty"`
+
+	// Accept header of artifact downloads, default application/vnd.github+json
+	DownloadAccept string `json:"downloadAccept,omitempty"`
+
+	// Download archives in up to this many ranges in parallel,
+	// if their storage supports ranges
+	DownloadChunks int `json:"downloadChunks,omitempty"`
+
+	// Name of an artifact uploaded by the same run holding a JSON manifest
+	// of file name to hash, the artifact is only downloaded if it changed
+	Manifest string `json:"manifest,omitempty"`
+
+	// Wait for queued or in-progress runs to finish before selecting the artifact
+	WaitForBuild bool     `json:"waitForBuild,omitempty"`
+	WaitTimeout  Duration `json:"waitTimeout,omitempty"` // default 10m
+
+	// Extra headers sent with every request of the job. Authorization
+	// can only be replaced when OverrideAuthorization is set.
+	Headers               map[string]string `json:"headers,omitempty"`
+	OverrideAuthorization bool              `json:"overrideAuthorization,omitempty"`
+
+	// Remove the deploys of deleted branches, deployPath must contain {branch}
+	CleanupPreviews bool `json:"cleanupPreviews,omitempty"`
+
+	// How changed files are detected: "hash" (default) compares content,
+	// "mtime" treats a file as changed if the entry is newer than the
+	// destination or their sizes differ, which can miss same-time edits
+	DiffMode string `json:"diffMode,omitempty"`
+
+	// Width of the MurMurHash3 content hashes of diffMode "hash",
+	// 32 or 128 (default), and their seed, default 0
+	HashWidth int    `json:"hashWidth,omitempty"`
+	HashSeed  uint32 `json:"hashSeed,omitempty"`
+
+	// How files are extracted to a local target: "temp" (default) hashes
+	// each file while streaming it and stages it in tempDir, "direct" streams it
+	// into a temp file next to the destination and renames it in place
+	ExtractMode string `json:"extractMode,omitempty"`
+
+	// Write every file without diffing it, for targets that
+	// are expensive or impossible to read back
+	SkipDiff bool `json:"skipDiff,omitempty"`
+
+	// Directory to store every deployed artifact in as a read-only tarball,
+	// with SnapshotOnly instead of extracting it to DeployPath
+	SnapshotPath string `json:"snapshotPath,omitempty"`
+	SnapshotOnly bool   `json:"snapshotOnly,omitempty"`
+
+	// Sign snapshot manifests with "gpg" or "cosign" and SignKey,
+	// a GPG key id or cosign key file, failing the deploy if signing fails
+	SignManifest string `json:"signManifest,omitempty"`
+	SignKey      string `json:"signKey,omitempty"`
+
+	// Record a fingerprint of the deployed files of every deploy path
+	Fingerprint bool `json:"fingerprint,omitempty"`
+
+	// Re-read the deployed files after extracting and fail
+	// the deploy if any doesn't match the artifact
+	Verify bool `json:"verify,omitempty"`
+
+	// Octal umask applied to written files and created directories,
+	// e.g. "027", by default files are 0644 and directories 0755
+	Umask string `json:"umask,omitempty"`
+
+	// How a local deploy path is updated: "inplace" (default) replaces
+	// changed files one by one, "swap" builds the new tree next to it and
+	// swaps the whole directory with renames
+	Strategy string `json:"strategy,omitempty"`
+
+	// Sync written files and their directories to disk for crash consistency
+	Fsync bool `json:"fsync,omitempty"`
+
+	// Where to deploy: "local" (default), "docker", into DeployPath
+	// inside Container through the Docker Engine API, or "exec", into
+	// DeployPath and then by running Command on it, see ExecContext
+	Target     string   `json:"target,omitempty"`
+	Container  string   `json:"container,omitempty"`
+	DockerHost string   `json:"dockerHost,omitempty"` // default $DOCKER_HOST or unix:///var/run/docker.sock
+	Command    []string `json:"command,omitempty"`
+
+	// Headers of changed files passed to exec targets, before the defaults
+	Metadata []ObjectMetadata `json:"metadata,omitempty"`
+
+	// Command run after every successful deploy, see runHook. The changed
+	// files it's told about are limited to the ones matching HookFiles,
+	// if set, and renamed by HookRewrite, e.g. to URLs
+	PostDeploy  []string      `json:"postDeploy,omitempty"`
+	HookFiles   []string      `json:"hookFiles,omitempty"`
+	HookRewrite []PathRewrite `json:"hookRewrite,omitempty"`
+
+	// Commands run when the job starts failing, after FailingAfter
+	// failed runs in a row (default 1), and when it first succeeds
+	// again, see notifyTransition
+	OnFailing    []string `json:"onFailing,omitempty"`
+	OnRecovered  []string `json:"onRecovered,omitempty"`
+	FailingAfter int      `json:"failingAfter,omitempty"`
+
+	// Check the deploy succeeded, and roll it back if not
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+
+	// Environment name -> fields overriding the ones above
+	Env map[string]json.RawMessage `json:"env,omitempty"`
+
+	Profile string `json:"profile,omitempty"` // set from -profiles when loaded
+}
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// PathRewrite replaces the matches of the regular expression Match
+// in a file name with Replace, which may refer to submatches as $1.
+type PathRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// Destination is one of several deploy targets of a job.
+type Destination struct {
+	DeployPath string   `json:"deployPath"`
+	Excludes   []string `json:"excludes,omitempty"` // defaults to the job's excludes
 }
 
 const (
@@ -42,40 +294,68 @@ const (
 )
 
 var (
-	secretMap  map[string]string
-	jobs       []Job
+	// Owner or Owner/Repo -> secret, and the jobs, replaced as a whole
+	// by refreshConfig and never modified, see currentSecrets and currentJobs
+	secretMap  atomic.Pointer[map[string]Secret]
+	jobList    atomic.Pointer[[]Job]
 	lastUpdate map[string]time.Time // Owner.Repo.ArtifactName -> created_at
 
+	// workflow run id -> element of runLRU, the most recently used
+	// first, holding its *runEntry
+	runCache   = make(map[int64]*list.Element)
+	runLRU     = list.New()
+	runCacheMu sync.Mutex
+
 	client = &http.Client{}
+
+	globalHeaders = make(http.Header) // -header
+	forceKeys     []string            // -force
+
+	env        = flag.String("env", "", "environment overlay to apply to jobs, defaults to $DEPLOYER_ENV")
+	userAgent  = flag.String("user-agent", "action-deployer/"+version, "User-Agent sent with every request")
+	listenAddr = flag.String("listen", "", "address of the HTTP control server, e.g. 127.0.0.1:8080")
+	minFree    = flag.Uint64("min-free", 64, "free space in MiB to keep on top of the artifact size, deploys are skipped otherwise")
+	debug      = flag.Bool("debug", false, "log debug messages")
+	jsonOutput = flag.Bool("json", false, "print command results as JSON")
+	pidFile    = flag.String("pidfile", "deployer.pid", "lock file preventing a second instance, empty to disable")
+	runOnStart = flag.Bool("run-on-start", true, "run every job on startup, otherwise wait one poll interval first")
 )
 
-func init() {
-	// init secret
-	secrets := make([]Secret, 0)
-	if err := loadJSON(secretFile, &secrets); err != nil {
+func setup() {
+	if err := loadProfiles(); err != nil {
 		log.Fatal(err)
 	}
-	secretMap = make(map[string]string)
-	for _, s := range secrets {
-		secretMap[s.Owner] = s.Token
+
+	// init secret
+	secrets, err := loadSecrets()
+	if err != nil {
+		log.Fatal(err)
 	}
+	setSecrets(secrets)
 
 	// init job
-	if err := loadJSON(jobFile, &jobs); err != nil {
+	if *env == "" {
+		*env = os.Getenv("DEPLOYER_ENV")
+	}
+	js, err := loadJobs()
+	if err != nil {
 		log.Fatal(err)
 	}
+	setJobs(js)
 
 	// init log
 	lastUpdate = make(map[string]time.Time)
-	_, err := os.Stat(logFile)
-	if os.IsNotExist(err) {
-		if err := os.WriteFile(logFile, []byte("{}"), 0644); err != nil {
-			log.Fatal(err)
-		}
+	if err := loadProfiled(logFile, lastUpdate); err != nil {
+		log.Fatal(err)
 	}
-	if err := loadJSON(logFile, &lastUpdate); err != nil {
+	if err := loadRecords(); err != nil {
 		log.Fatal(err)
 	}
+	if *perJobState {
+		if err := loadJobStates(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// init directory structure
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
@@ -86,228 +366,1312 @@ func init() {
 	}
 }
 
+// currentJobs returns the jobs in effect. The slice must not be modified.
+func currentJobs() []Job {
+	if js := jobList.Load(); js != nil {
+		return *js
+	}
+	return nil
+}
+
+func setJobs(js []Job) {
+	jobList.Store(&js)
+}
+
+// currentSecrets returns the secrets in effect. The map must not be modified.
+func currentSecrets() map[string]Secret {
+	if m := secretMap.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+func setSecrets(m map[string]Secret) {
+	secretMap.Store(&m)
+}
+
+// loadSecrets returns the tokens by owner or owner/repo,
+// from -secret-url if set or the secret file.
+func loadSecrets() (map[string]Secret, error) {
+	m := make(map[string]Secret)
+	for _, p := range configProfiles() {
+		secrets := make([]Secret, 0)
+		var err error
+		if *secretURL != "" {
+			err = loadRemoteConfig(*secretURL, remoteSecretFile, &secrets)
+		} else {
+			err = loadConfig(findConfig(p.path(secretFile)), &secrets)
+		}
+		if err != nil {
+			return nil, err
+		}
+		prefix := profilePrefix(p.Name)
+		for _, s := range secrets {
+			if err := validateSecret(s); err != nil {
+				return nil, fmt.Errorf("secret for %v: %v", s.Owner, err)
+			}
+			if s.Repo != "" {
+				m[prefix+s.Owner+"/"+s.Repo] = s
+			} else {
+				m[prefix+s.Owner] = s
+			}
+		}
+	}
+	return m, nil
+}
+
+// loadJobs returns the jobs with the environment overlay applied,
+// from -config-url if set or the job file.
+func loadJobs() ([]Job, error) {
+	var all []Job
+	for _, p := range configProfiles() {
+		var js []Job
+		var err error
+		if *configURL != "" {
+			err = loadRemoteConfig(*configURL, remoteJobFile, &js)
+		} else {
+			err = loadConfig(findConfig(p.path(jobFile)), &js)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range js {
+			js[i].Profile = p.Name
+			if err := applyEnv(&js[i], *env); err != nil {
+				return nil, fmt.Errorf("job %v: env %v: %v", jobKey(js[i]), *env, err)
+			}
+		}
+		all = append(all, js...)
+	}
+	return all, nil
+}
+
+func init() {
+	flag.Func("header", "extra `Name: value` header sent with every request, may be repeated", func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok {
+			return errors.New("expected Name: value")
+		}
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "Authorization" {
+			return errors.New("Authorization can't be set globally")
+		}
+		globalHeaders.Add(name, strings.TrimSpace(value))
+		return nil
+	})
+	flag.Func("force", "redeploy the latest artifact of job `key` on the first run even if already deployed, may be repeated", func(v string) error {
+		forceKeys = append(forceKeys, v)
+		return nil
+	})
+}
+
 func main() {
-	for {
-		runJobs()
-		time.Sleep(5 * time.Minute)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n  check\tvalidate config and test connectivity without deploying\n  config\tprint the effective configuration\n  diff [job]\treport the files a deploy of the latest artifact would change\n  validate-zip <zip or job> [job]\tlist the entries of a zip and what a deploy would do with them\n  repair-state\trestore the state lost to a corrupt log.json from state.json\n  which <file>...\tprint the job and artifact that last deployed each file\n\nFlags:\n")
+		flag.PrintDefaults()
 	}
+	flag.Parse()
+	if *logPath != "" {
+		f, err := openLogFile(*logPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(f)
+	}
+	client.Transport = newTransport()
+	setup()
+
+	switch flag.Arg(0) {
+	case "":
+	case "check":
+		if !runCheck() {
+			os.Exit(1)
+		}
+		return
+	case "config":
+		runConfig()
+		return
+	case "diff":
+		if !runDiff(flag.Arg(1)) {
+			os.Exit(1)
+		}
+		return
+	case "repair-state":
+		if !runRepairState() {
+			os.Exit(1)
+		}
+		return
+	case "validate-zip":
+		if !runValidateZip(flag.Arg(1), flag.Arg(2)) {
+			os.Exit(1)
+		}
+		return
+	case "which":
+		if !runWhich(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	prepareJobs()
+	if *listenAddr != "" {
+		if err := checkListen(*listenAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, key := range forceKeys {
+		if err := setForce(key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pidFile != "" {
+		if err := acquireLock(*pidFile); err != nil {
+			log.Fatal(err)
+		}
+		defer releaseLock(*pidFile)
+	}
+	if *leaderElect {
+		var err error
+		if leader, err = newElector(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the first signal stops the running job and exits,
+	// a second one exits right away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	cleanTemp()
+	if *reconcileFlag && leader == nil {
+		reconcileJobs(ctx)
+	}
+	var elected sync.WaitGroup
+	if leader != nil {
+		elected.Add(1)
+		go func() {
+			defer elected.Done()
+			leader.run(ctx)
+		}()
+		// released before exiting, another replica takes over right away
+		defer elected.Wait()
+	}
+
+	if *listenAddr != "" {
+		go serve(*listenAddr)
+	}
+
+	if *systemdNotify {
+		startWatchdog()
+	}
+	startTracing()
+	defer stopTracing()
+	lastRefresh := clock.Now()
+	polls := make(pollSchedule)
+	woken := *runOnStart
+	if !*runOnStart {
+		polls.postpone(clock.Now())
+		log.Printf("[Info] First poll cycle in %v\n", polls.wait(clock.Now()).Round(time.Second))
+	}
+	var term context.Context
+	for ready := false; ctx.Err() == nil; {
+		if *configRefresh > 0 && clock.Now().Sub(lastRefresh) >= *configRefresh {
+			refreshConfig()
+			lastRefresh = clock.Now()
+		}
+		jctx, leading := ctx, true
+		if leader != nil {
+			// followers stay warm, with the config loaded, until elected
+			var t context.Context
+			if t, leading = leader.leading(); leading {
+				jctx = t
+				if t != term && *reconcileFlag {
+					reconcileJobs(t)
+				}
+				term = t
+			}
+		}
+		if js := polls.due(clock.Now(), woken); leading && len(js) > 0 {
+			runJobs(jctx, js)
+		}
+		woken = false
+		if *systemdNotify && !ready {
+			if err := sdNotify("READY=1"); err != nil {
+				log.Printf("[Warn] systemd notify: %v\n", err)
+			}
+			ready = true
+		}
+		select {
+		case <-clock.After(polls.wait(clock.Now())):
+		case <-wake:
+			woken = true
+		case <-ctx.Done():
+		}
+	}
+	log.Printf("[Info] Shutting down\n")
+}
+
+func runJobs(ctx context.Context, js []Job) {
+	start := clock.Now()
+	markCycle(start)
+	defer markCycle(time.Time{})
+	var deployed, files, unchanged, skipped, failed int
+	for _, j := range js {
+		if ctx.Err() != nil {
+			break
+		}
+		r := runJob(ctx, j)
+		switch r.Status {
+		case statusDeployed:
+			deployed++
+			files += r.Files
+		case statusUnchanged:
+			unchanged++
+		case statusError:
+			failed++
+		default:
+			skipped++
+		}
+	}
+	log.Printf("[Info] Cycle finished in %v: %d jobs, %d deployed (%d files), %d unchanged, %d skipped, %d errored\n",
+		clock.Now().Sub(start).Round(time.Millisecond), len(js), deployed, files, unchanged, skipped, failed)
+}
+
+const (
+	statusDeployed  = "deployed"
+	statusUnchanged = "unchanged"
+	statusSkipped   = "skipped"
+	statusPending   = "pending"
+	statusMissing   = "missing"
+	statusPaused    = "paused"
+	statusError     = "error"
+)
+
+// jobResult is the outcome of a single job run.
+type jobResult struct {
+	Status       string
+	Files        int               // files written
+	Changed      []string          // destination names of the files written
+	Fingerprints map[string]string // deploy path -> fingerprint, if enabled
+}
+
+// applyEnv merges the overlay for environment name into the job.
+// Fields present in the overlay replace the base ones.
+func applyEnv(j *Job, name string) error {
+	overlays := j.Env
+	j.Env = nil
+	if name == "" {
+		return nil
+	}
+	raw, ok := overlays[name]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(raw, j)
+}
+
+// formatLabels formats labels as sorted " k=v" pairs for log lines.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, " %v=%v", k, labels[k])
+	}
+	return sb.String()
+}
+
+func jobKey(j Job) string {
+	key := fmt.Sprintf("%v%v.%v.%v", profilePrefix(j.Profile), j.Owner, j.Repo, j.ArtifactName)
+	if j.NameLabels != nil {
+		key += j.NameLabels.labelsKey()
+	}
+	return key
+}
+
+func runJob(ctx context.Context, j Job) jobResult {
+	key := jobKey(j)
+	if isPaused(key) {
+		log.Printf("[Info] Job %v is paused\n", key)
+		return jobResult{Status: statusPaused}
+	}
+	ctx = withRequestID(ctx, newRequestID())
+	log.Printf("[Info] Running job: %v [%v]%v\n", key, requestID(ctx), formatLabels(j.Labels))
+	ctx, sp := startSpan(ctx, "job")
+	sp.set("deployer.job", key)
+	sp.set("deployer.request_id", requestID(ctx))
+	if j.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout.Duration)
+		defer cancel()
+	}
+
+	force := takeForce(key)
+	if force {
+		log.Printf("[Info] Job %v [%v]: forced redeploy\n", key, requestID(ctx))
+		// diff every file
+		j.SkipUnchangedDirs = false
+	}
+	r, err := deployLatest(ctx, j, key, force)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v: %w", j.Timeout.Duration, err)
+	}
+	if errors.Is(err, errNoArtifact) {
+		r, err = missingArtifact(ctx, j, key, err)
+	} else if err != nil {
+		log.Printf("[Error] Job %v [%v]%v: %v\n", key, requestID(ctx), formatLabels(j.Labels), err)
+		r.Status = statusError
+	}
+	if j.CleanupPreviews {
+		if err := cleanupPreviews(ctx, j, key); err != nil {
+			log.Printf("[Error] Job %v [%v]: cleanup previews: %v\n", key, requestID(ctx), err)
+		}
+	}
+	if t, n := recordRun(j, key, err); t != "" {
+		notifyTransition(ctx, j, key, t, n, err)
+	}
+	if j.MissingBackoff.Duration > 0 {
+		backoff(j, key, r.Status == statusMissing || errors.Is(err, errNoArtifact))
+	}
+	sp.set("deployer.status", r.Status)
+	sp.finish(err)
+	return r
 }
 
-func runJobs() {
-	for _, j := range jobs {
-		runJob(j)
+// missingArtifact logs that no artifact was found at the job's
+// onMissing level and returns err only if it counts as a failure.
+func missingArtifact(ctx context.Context, j Job, key string, err error) (jobResult, error) {
+	switch j.OnMissing {
+	case "warn":
+		log.Printf("[Warn] Job %v [%v]%v: %v\n", key, requestID(ctx), formatLabels(j.Labels), err)
+	case "debug":
+		debugf("Job %v [%v]%v: %v\n", key, requestID(ctx), formatLabels(j.Labels), err)
+	default:
+		log.Printf("[Error] Job %v [%v]%v: %v\n", key, requestID(ctx), formatLabels(j.Labels), err)
+	}
+
+	fails := j.OnMissing == "" || j.OnMissing == "error"
+	if j.MissingIsFailure != nil {
+		fails = *j.MissingIsFailure
 	}
+	if fails {
+		return jobResult{Status: statusError}, err
+	}
+	return jobResult{Status: statusMissing}, nil
 }
 
-func runJob(j Job) {
-	key := fmt.Sprintf("%v.%v.%v", j.Owner, j.Repo, j.ArtifactName)
-	log.Printf("[Info] Running job: %v\n", key)
+func debugf(format string, v ...any) {
+	if *debug {
+		log.Printf("[Debug] "+format, v...)
+	}
+}
 
-	artifact, err := getLatestArtifact(j)
+// deployLatest deploys the latest artifact of the job
+// unless it has already been deployed and force isn't set.
+// Force only redeploys the deployed artifact, a new one still
+// needs to pass the health, interval and approval checks.
+func deployLatest(ctx context.Context, j Job, key string, force bool) (jobResult, error) {
+	if j.WaitForBuild {
+		if err := waitForBuild(ctx, j, key); err != nil {
+			return jobResult{}, err
+		}
+	}
+
+	lctx, sp := startSpan(ctx, "list")
+	artifact, err := getLatestArtifact(lctx, j)
+	sp.setArtifact(artifact)
+	sp.finish(err)
 	if err != nil {
-		log.Printf("[Error] Job %v: %v\n", key, err)
-		return
+		return jobResult{}, err
+	}
+	spanFrom(ctx).setArtifact(artifact)
+	if j.pinned() {
+		reportNewer(ctx, j, key, artifact)
 	}
 
-	if artifact.CreatedAt.Equal(lastUpdate[key]) {
-		return
+	deployed := artifact.CreatedAt.Equal(getLastUpdate(key))
+	if deployed && !force {
+		return jobResult{Status: statusUnchanged}, nil
+	}
+	if j.HealthCheck != nil && unhealthy(key, artifact.ID) {
+		markPending(key, artifact, "failed health check")
+		debugf("Job %v [%v]: artifact %v failed its health check, waiting for a newer one\n", key, requestID(ctx), artifact.ID)
+		return jobResult{Status: statusPending}, nil
 	}
-	markUpdate(key, artifact.CreatedAt)
 
-	if err := downloadArtifact(j.Owner, artifact, key); err != nil {
-		log.Printf("[Error] Job %v: %v\n", key, err)
-		return
+	// let a multi-artifact build finish publishing, the
+	// artifact is deployed once it stayed the latest long enough
+	if settle := j.Settle.Duration; settle > 0 && !deployed && !j.pinned() {
+		since := markPending(key, artifact, "settling")
+		if wait := settle - clock.Now().Sub(since); wait > 0 {
+			log.Printf("[Info] Job %v [%v]: artifact %v settling, deploying in %v\n",
+				key, requestID(ctx), artifact.ID, wait.Round(time.Second))
+			return jobResult{Status: statusPending}, nil
+		}
 	}
 
-	if err := unzipDiff(
-		filepath.Join(artifactsDir, key+".zip"),
-		j.DeployPath,
-		j.Excludes,
-	); err != nil {
-		log.Printf("[Error] Job %v: %v\n", key, err)
-		return
+	// coalesce a flurry of builds into one deploy per interval
+	if interval := j.MinDeployInterval.Duration; interval > 0 && !deployed {
+		if d := lastDeploy(key); d != nil {
+			if wait := interval - clock.Now().Sub(d.DeployedAt); wait > 0 {
+				markPending(key, artifact, "rate limited")
+				log.Printf("[Info] Job %v [%v]: artifact %v rate limited, deploying in %v\n",
+					key, requestID(ctx), artifact.ID, wait.Round(time.Second))
+				return jobResult{Status: statusPending}, nil
+			}
+		}
+	}
+
+	if j.RequireApproval && !deployed && !isApproved(key, artifact.ID) {
+		markPending(key, artifact, "awaiting approval")
+		log.Printf("[Info] Job %v [%v]: artifact %v awaiting approval\n", key, requestID(ctx), artifact.ID)
+		return jobResult{Status: statusPending}, nil
+	}
+
+	if !inWindow(j, clock.Now()) {
+		markPending(key, artifact, "waiting for deploy window")
+		log.Printf("[Info] Job %v [%v]: artifact %v waiting for deploy window\n", key, requestID(ctx), artifact.ID)
+		return jobResult{Status: statusPending}, nil
+	}
+
+	var manifest string
+	if j.Manifest != "" && !deployed {
+		var same bool
+		if manifest, same, err = manifestUnchanged(ctx, j, key, artifact); err != nil {
+			return jobResult{}, err
+		} else if same {
+			return jobResult{Status: statusUnchanged}, nil
+		}
+	}
+
+	if err := checkFreeSpace(tempDir, uint64(artifact.SizeInBytes)); err != nil {
+		log.Printf("[Warn] Job %v [%v]: skipping deploy: %v\n", key, requestID(ctx), err)
+		return jobResult{Status: statusSkipped}, nil
+	}
+	// a deleted or expired artifact can't be downloaded,
+	// fall back to the newest one that still can
+	gone := make(map[int64]bool)
+	for {
+		dctx, sp := startSpan(ctx, "download")
+		sp.setArtifact(artifact)
+		sp.set("deployer.artifact.size", artifact.SizeInBytes)
+		err := downloadArtifact(dctx, j, artifact, key)
+		sp.finish(err)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errArtifactGone) {
+			return jobResult{}, err
+		}
+		gone[artifact.ID] = true
+		prev := artifact.ID
+		if artifact, err = selectArtifact(ctx, j, gone); err != nil {
+			return jobResult{}, err
+		}
+		spanFrom(ctx).setArtifact(artifact)
+		log.Printf("[Warn] Job %v [%v]: artifact %v is no longer available, selecting artifact %v created %v instead\n",
+			key, requestID(ctx), prev, artifact.ID, artifact.CreatedAt)
+		if artifact.CreatedAt.Equal(getLastUpdate(key)) {
+			clearPending(key)
+			return jobResult{Status: statusUnchanged}, nil
+		}
+		// the fallback wasn't the one approved
+		if j.RequireApproval && !isApproved(key, artifact.ID) {
+			markPending(key, artifact, "awaiting approval")
+			log.Printf("[Info] Job %v [%v]: artifact %v awaiting approval\n", key, requestID(ctx), artifact.ID)
+			return jobResult{Status: statusPending}, nil
+		}
+		manifest = ""
+		if err := checkFreeSpace(tempDir, uint64(artifact.SizeInBytes)); err != nil {
+			log.Printf("[Warn] Job %v [%v]: skipping deploy: %v\n", key, requestID(ctx), err)
+			return jobResult{Status: statusSkipped}, nil
+		}
+	}
+
+	if j.VerifyAttestation {
+		if err := verifyAttestation(ctx, j, filepath.Join(artifactsDir, key+".zip")); err != nil {
+			return jobResult{}, err
+		}
+	}
+
+	filename := filepath.Join(artifactsDir, key+".zip")
+	if err := unwrapArchive(j, filename); err != nil {
+		return jobResult{}, err
+	}
+	files, size, err := deploy.ArchiveStats(filename, j.Excludes)
+	if err != nil {
+		return jobResult{}, err
+	}
+	if err := checkShrink(j, key, files, size); err != nil {
+		return jobResult{}, err
 	}
+
+	res := jobResult{Status: statusDeployed}
+	var snapshot string
+	if j.SnapshotPath != "" {
+		if snapshot, err = writeSnapshot(ctx, j, filename, artifact); err != nil {
+			return jobResult{}, fmt.Errorf("snapshot: %v", err)
+		}
+		log.Printf("[Info] Job %v [%v]: stored snapshot %v\n", key, requestID(ctx), snapshot)
+		if j.SnapshotOnly {
+			res.Files = files
+		}
+	}
+
+	// the artifact is downloaded once and deployed to every target,
+	// a failing target doesn't stop the others
+	targets := destinations(j)
+	var errs []error
+	done := 0
+	written := make(map[string][]string) // deploy path -> files written, undone by a rollback
+	for _, tj := range targets {
+		ectx, sp := startSpan(ctx, "extract")
+		sp.set("deployer.deploy_path", tj.DeployPath)
+		r, err := deployTarget(ectx, tj, key, filename, artifact)
+		sp.set("deployer.files", r.Files)
+		sp.finish(err)
+		switch {
+		case err != nil:
+			if len(targets) > 1 {
+				log.Printf("[Error] Job %v [%v]: target %v: %v\n", key, requestID(ctx), tj.DeployPath, err)
+			}
+			errs = append(errs, err)
+		case r.Status == statusDeployed:
+			done++
+			res.Files += r.Files
+			res.Changed = append(res.Changed, r.Changed...)
+			written[tj.DeployPath] = r.Changed
+			for p, fp := range r.Fingerprints {
+				if res.Fingerprints == nil {
+					res.Fingerprints = make(map[string]string)
+				}
+				res.Fingerprints[p] = fp
+			}
+		}
+	}
+
+	if len(targets) > 0 && (done == 0 || done < len(targets) && !j.AdvanceOnPartial) {
+		switch {
+		case len(targets) == 1 && len(errs) == 1:
+			return jobResult{}, errs[0]
+		case len(errs) > 0:
+			return jobResult{Files: res.Files}, fmt.Errorf("%d of %d targets failed", len(errs), len(targets))
+		}
+		return jobResult{Status: statusSkipped, Files: res.Files}, nil
+	}
+
+	// a failing hook doesn't undo the deploy, the run fails once it's recorded
+	var hookErr error
+	if len(j.PostDeploy) > 0 {
+		hctx, sp := startSpan(ctx, "hook")
+		sp.set("deployer.changed", len(res.Changed))
+		hookErr = runHook(hctx, j, key, artifact, res.Changed)
+		sp.finish(hookErr)
+	}
+	if j.HealthCheck != nil {
+		if err := checkHealth(ctx, j, key); err != nil {
+			return jobResult{Files: res.Files}, failHealthCheck(ctx, j, key, artifact, written, err)
+		}
+	}
+
+	err = markUpdate(key, artifact.CreatedAt)
+	clearPending(key)
+	if rerr := recordDeploy(key, Deploy{
+		ArtifactID: artifact.ID,
+		CreatedAt:  artifact.CreatedAt,
+		SHA:        artifact.WorkflowRun.HeadSHA,
+		DeployedAt: clock.Now(),
+		Files:      files,
+		Size:       size,
+		Manifest:   manifest,
+		Snapshot:   snapshot,
+
+		Fingerprints: res.Fingerprints,
+	}); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return jobResult{}, fmt.Errorf("artifact %v deployed, but saving the state failed: %v", artifact.ID, err)
+	}
+	if len(errs) > 0 {
+		return res, errors.Join(fmt.Errorf("%d of %d targets failed", len(errs), len(targets)), hookErr)
+	}
+	return res, hookErr
 }
 
-func markUpdate(key string, t time.Time) {
-	lastUpdate[key] = t
-	if err := saveJSON(logFile, lastUpdate); err != nil {
-		log.Fatal(err)
+// destinations returns the job once for every deploy target,
+// each with the target's deploy path and excludes. Snapshot-only
+// jobs have none.
+func destinations(j Job) []Job {
+	if j.SnapshotOnly {
+		return nil
 	}
+	if len(j.Targets) == 0 {
+		return []Job{j}
+	}
+	js := make([]Job, 0, len(j.Targets))
+	for _, t := range j.Targets {
+		tj := j
+		tj.Targets = nil
+		tj.DeployPath = t.DeployPath
+		if t.Excludes != nil {
+			tj.Excludes = t.Excludes
+		}
+		js = append(js, tj)
+	}
+	return js
 }
 
-func getLatestArtifact(j Job) (*Artifact, error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/actions/artifacts", j.Owner, j.Repo)
-	req, err := http.NewRequest("GET", url, nil)
+// deployTarget extracts the artifact downloaded to filename into a single target.
+func deployTarget(ctx context.Context, j Job, key, filename string, artifact *Artifact) (jobResult, error) {
+	if j.Target == "docker" {
+		res, err := unzipDiff(ctx, filename, j, key)
+		if err == nil {
+			err = failedFiles(res)
+		}
+		if err != nil {
+			return jobResult{}, err
+		}
+		return withFingerprint(ctx, j, filename, jobResult{Status: statusDeployed, Files: len(res.Written), Changed: res.Written})
+	}
+
+	if isTemplate(j.DeployPath) {
+		var err error
+		if j.DeployPath, err = expandDeployPath(j.DeployPath, artifact); err != nil {
+			return jobResult{}, err
+		}
+		_, err = os.Stat(j.DeployPath)
+		created := os.IsNotExist(err)
+		if err := os.MkdirAll(j.DeployPath, 0755); err != nil {
+			return jobResult{}, err
+		}
+		if j.CleanupPreviews && created {
+			if err := trackPreview(key, artifact.WorkflowRun.HeadBranch, j.DeployPath); err != nil {
+				return jobResult{}, err
+			}
+		}
+	}
+	if fi, err := os.Stat(j.DeployPath); err != nil {
+		return jobResult{}, fmt.Errorf("deploy path: %v", err)
+	} else if !fi.IsDir() {
+		return jobResult{}, fmt.Errorf("deploy path %v is not a directory", j.DeployPath)
+	}
+
+	_, size, err := deploy.ArchiveStats(filename, j.Excludes)
 	if err != nil {
-		return nil, err
+		return jobResult{}, err
+	}
+	if err := checkFreeSpace(j.DeployPath, size); err != nil {
+		log.Printf("[Warn] Job %v [%v]: skipping deploy to %v: %v\n", key, requestID(ctx), j.DeployPath, err)
+		return jobResult{Status: statusSkipped}, nil
+	}
+
+	var res deploy.Result
+	if j.Strategy == "swap" {
+		res, err = swapDeploy(ctx, filename, j, key)
+	} else {
+		res, err = unzipDiff(ctx, filename, j, key)
 	}
-	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("Authorization", "Bearer "+secretMap[j.Owner])
-	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return jobResult{}, err
 	}
-	defer resp.Body.Close()
+	if err := recordProvenance(ctx, j, key, artifact.ID, res.Written); err != nil {
+		return jobResult{}, err
+	}
+	// the deploy isn't recorded, so the failed files are retried on the next run
+	if err := failedFiles(res); err != nil {
+		return jobResult{}, err
+	}
+	if j.Target == "exec" {
+		if err := runExecTarget(ctx, j, key, artifact, res.Changes); err != nil {
+			return jobResult{}, err
+		}
+	}
+	return withFingerprint(ctx, j, filename, jobResult{Status: statusDeployed, Files: len(res.Written), Changed: res.Written})
+}
 
-	as := new(Artifacts)
-	if err := json.NewDecoder(resp.Body).Decode(as); err != nil {
-		return nil, err
+// failedFiles returns an error if files of res failed to extract.
+func failedFiles(res deploy.Result) error {
+	if res.Failed > 0 {
+		return fmt.Errorf("%d files failed to extract, see the log", res.Failed)
 	}
+	return nil
+}
 
-	// sort by created_at
-	slices.SortFunc(as.Artifacts, func(i, j Artifact) int {
-		return j.CreatedAt.Compare(i.CreatedAt)
-	})
-	// only return the artifact with correct name
-	for i := 0; i < len(as.Artifacts); i++ {
-		if as.Artifacts[i].Name == j.ArtifactName {
-			return &as.Artifacts[i], nil
+// withFingerprint adds the fingerprint of the job's deploy path
+// to r if the job records them.
+func withFingerprint(ctx context.Context, j Job, filename string, r jobResult) (jobResult, error) {
+	if !j.Fingerprint {
+		return r, nil
+	}
+	opts, err := extractOptions(ctx, j)
+	if err != nil {
+		return r, err
+	}
+	fp, err := deploy.Fingerprint(ctx, filename, opts)
+	if err != nil {
+		return r, fmt.Errorf("fingerprint: %v", err)
+	}
+	r.Fingerprints = map[string]string{j.DeployPath: fp}
+	return r, nil
+}
+
+// checkFreeSpace reports an error if the filesystem containing path
+// has less than size bytes available on top of the -min-free headroom.
+func checkFreeSpace(path string, size uint64) error {
+	free, err := freeSpace(path)
+	if err != nil {
+		// can't tell, don't block the deploy
+		return nil
+	}
+	need := size + *minFree<<20
+	if free < need {
+		return fmt.Errorf("insufficient space on %v: %d MiB free, %d MiB needed", path, free>>20, need>>20)
+	}
+	return nil
+}
+
+func getLastUpdate(key string) time.Time {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return lastUpdate[key]
+}
+
+// markUpdate records t as the creation time of the job's deployed
+// artifact. It's kept in memory even if it can't be saved, so the
+// artifact isn't deployed again, and saved with the next update.
+func markUpdate(key string, t time.Time) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	lastUpdate[key] = t
+	if *perJobState {
+		return saveJobState(key)
+	}
+	return saveProfiled(logFile, lastUpdate)
+}
+
+// tokenFor returns the token for the job's repo, falling back
+// to the owner-level token, from its helper if it has one.
+func tokenFor(ctx context.Context, j Job) (string, error) {
+	key, s := secretFor(j)
+	if !s.helper() {
+		return s.Token, nil
+	}
+	return helperToken(ctx, key, s)
+}
+
+const defaultAPIURL = "https://api.github.com"
+
+// apiBase returns the GitHub API URL of the job's repo, its own or the
+// one of its repo or owner secret, defaulting to public GitHub.
+func apiBase(j Job) string {
+	prefix := profilePrefix(j.Profile)
+	secrets := currentSecrets()
+	for _, u := range []string{j.APIURL, secrets[prefix+j.Owner+"/"+j.Repo].APIURL, secrets[prefix+j.Owner].APIURL} {
+		if u != "" {
+			return strings.TrimSuffix(u, "/")
 		}
 	}
+	return defaultAPIURL
+}
 
-	return nil, fmt.Errorf("no artifact found")
+// repoURL returns the API URL of the job's repo.
+func repoURL(j Job) string {
+	return fmt.Sprintf("%s/repos/%s/%s", apiBase(j), j.Owner, j.Repo)
 }
 
-func downloadArtifact(owner string, a *Artifact, filename string) error {
-	url := a.ArchiveDownloadURL
-	req, err := http.NewRequest("GET", url, nil)
+func validateAPIURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid apiUrl %q: %v", s, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("invalid apiUrl %q: not an http(s) URL", s)
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// newRequestID returns a random id correlating the requests
+// and log lines of a single job run.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequest creates a GitHub API request authorized for the job's repo.
+func newRequest(ctx context.Context, j Job, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", *userAgent)
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	token, err := tokenFor(ctx, j)
+	if err != nil {
+		return nil, err
 	}
 	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("Authorization", "Bearer "+secretMap[owner])
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	for k, vs := range globalHeaders {
+		req.Header[k] = vs
 	}
-	defer resp.Body.Close()
+	for k, v := range j.Headers {
+		if http.CanonicalHeaderKey(k) == "Authorization" && !j.OverrideAuthorization {
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
 
-	// write to file
-	file, err := os.CreateTemp(tempDir, "artifact-tmp-*")
+// getJSON requests url from the GitHub API and decodes the response into v.
+func getJSON(ctx context.Context, j Job, url string, v any) error {
+	req, err := newRequest(ctx, j, url)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(file, resp.Body); err != nil {
+	resp, err := sched.Do(ctx, j.Owner, req)
+	if err != nil {
 		return err
 	}
-	file.Close()
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// a rotated token is fetched again from the helper on the next request
+		forgetToken(j)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", req.URL.Path, resp.Status)
+	}
 
-	return os.Rename(file.Name(), filepath.Join(artifactsDir, filename+".zip"))
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func unzipDiff(filename string, dest string, excludes []string) error {
-	r, err := zip.OpenReader(filename)
-	if err != nil {
-		return err
+func getLatestArtifact(ctx context.Context, j Job) (*Artifact, error) {
+	return selectArtifact(ctx, j, nil)
+}
+
+// selectArtifact returns the newest artifact of the job, or the one
+// it's pinned to, that is neither expired nor in skip.
+func selectArtifact(ctx context.Context, j Job, skip map[int64]bool) (*Artifact, error) {
+	if j.Source == "release" {
+		return selectReleaseAsset(ctx, j, skip)
+	}
+	// the API lists the newest artifacts first, so a match on a page
+	// is newer than any on the next one
+	pages := j.maxPages()
+	for page := 1; page <= pages; page++ {
+		url := fmt.Sprintf("%s/actions/artifacts?per_page=%d&page=%d", repoURL(j), artifactsPerPage, page)
+		as := new(Artifacts)
+		if err := getJSON(ctx, j, url, as); err != nil {
+			return nil, err
+		}
+		if a, err := matchArtifact(ctx, j, as.Artifacts, skip); a != nil || err != nil {
+			return a, err
+		}
+		if len(as.Artifacts) < artifactsPerPage || int64(page*artifactsPerPage) >= as.TotalCount {
+			return nil, errNoArtifact
+		}
 	}
-	defer r.Close()
+	return nil, fmt.Errorf("matching artifact not found within scan limit of %d artifacts, see maxPages: %w", pages*artifactsPerPage, errNoArtifact)
+}
 
-	wg := sync.WaitGroup{}
-	for _, f := range r.File {
-		if f.FileInfo().IsDir() {
+const (
+	artifactsPerPage = 100
+	defaultMaxPages  = 10
+)
+
+func (j Job) maxPages() int {
+	if j.MaxPages > 0 {
+		return j.MaxPages
+	}
+	return defaultMaxPages
+}
+
+// matchArtifact returns the newest of the listed artifacts the job
+// selects, or nil if none.
+func matchArtifact(ctx context.Context, j Job, as []Artifact, skip map[int64]bool) (*Artifact, error) {
+	// sort by created_at, newest first
+	slices.SortFunc(as, func(a, b Artifact) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		// break ties so re-runs sharing a timestamp pick the newest
+		if j.TieBreaker == "run" {
+			if c := cmp.Compare(b.WorkflowRun.ID, a.WorkflowRun.ID); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	// only return the artifact with correct name
+	for i := 0; i < len(as); i++ {
+		if j.NameLabels != nil && !j.labelsMatch(as[i].Name) ||
+			j.NameLabels == nil && !j.nameMatches(as[i].Name) {
 			continue
 		}
-		if pathMatches(f.Name, excludes) {
+		if as[i].Expired || skip[as[i].ID] {
 			continue
 		}
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := extractDiff(f, dest); err != nil {
-				log.Printf("[Error] Extract %v: %v\n", f.Name, err)
+		if !j.pinMatches(&as[i]) {
+			continue
+		}
+		if j.Branch != "" && as[i].WorkflowRun.HeadBranch != j.Branch {
+			continue
+		}
+		if j.Workflow != "" || len(j.AllowedActors) > 0 {
+			run, err := getRun(ctx, j, as[i].WorkflowRun.ID)
+			if err != nil {
+				return nil, err
 			}
-		}()
+			if j.Workflow != "" && !run.matchesWorkflow(j.Workflow) {
+				continue
+			}
+			if len(j.AllowedActors) > 0 && !run.actorAllowed(j.AllowedActors) {
+				debugf("Job %v [%v]: skipping artifact %v of run %v triggered by %v\n",
+					jobKey(j), requestID(ctx), as[i].ID, run.ID, run.TriggeringActor.Login)
+				continue
+			}
+		}
+		return &as[i], nil
 	}
-	wg.Wait()
-	return nil
+	return nil, nil
 }
 
-func extractDiff(f *zip.File, dest string) error {
-	rc, err := f.Open()
+var errNoArtifact = errors.New("no artifact found")
+
+func (j Job) pinned() bool {
+	return j.PinArtifact != 0 || j.PinSHA != ""
+}
+
+// pinMatches reports whether a is the artifact the job is pinned to,
+// always true for a job that isn't pinned.
+func (j Job) pinMatches(a *Artifact) bool {
+	if j.PinArtifact != 0 && a.ID != j.PinArtifact {
+		return false
+	}
+	return j.PinSHA == "" || strings.HasPrefix(a.WorkflowRun.HeadSHA, strings.ToLower(j.PinSHA))
+}
+
+// nameMatches reports whether the artifact name is the job's
+// ArtifactName, ignoring case with CaseInsensitiveName.
+func (j Job) nameMatches(name string) bool {
+	if j.CaseInsensitiveName {
+		return strings.EqualFold(name, j.ArtifactName)
+	}
+	return name == j.ArtifactName
+}
+
+// reportNewer logs and marks as pending the latest artifact of a pinned
+// job if it's newer than the pinned one, which is deployed instead.
+func reportNewer(ctx context.Context, j Job, key string, pinned *Artifact) {
+	j.PinArtifact, j.PinSHA = 0, ""
+	latest, err := getLatestArtifact(ctx, j)
 	if err != nil {
-		return err
+		debugf("Job %v [%v]: checking for newer artifacts: %v\n", key, requestID(ctx), err)
+		return
 	}
-	b := &bytes.Buffer{}
-	if _, err := io.Copy(b, rc); err != nil {
-		return err
+	if latest.ID == pinned.ID || !latest.CreatedAt.After(pinned.CreatedAt) {
+		return
 	}
-	if err := rc.Close(); err != nil {
-		return err
+	markPending(key, latest, fmt.Sprintf("pinned to artifact %v", pinned.ID))
+	log.Printf("[Info] Job %v [%v]: newer artifact %v available but pinned to %v\n",
+		key, requestID(ctx), latest.ID, pinned.ID)
+}
+
+// errArtifactGone means the selected artifact was deleted or expired.
+var errArtifactGone = errors.New("artifact no longer available")
+
+// maxCachedRuns bounds the run cache, far more than the runs of the
+// artifacts a cycle lists.
+const maxCachedRuns = 1000
+
+// runEntry is a cached workflow run, fetched once by the first caller
+// while the others wait for done.
+type runEntry struct {
+	id   int64
+	done chan struct{}
+	run  *Run
+	err  error
+}
+
+// getRun returns the workflow run with the given id.
+// Runs are cached since their workflow never changes, the least
+// recently used dropped beyond maxCachedRuns. Only the first caller
+// for an id fetches it, without holding runCacheMu, and failed
+// fetches are forgotten so the next caller retries.
+func getRun(ctx context.Context, j Job, id int64) (*Run, error) {
+	runCacheMu.Lock()
+	el, ok := runCache[id]
+	if ok {
+		runLRU.MoveToFront(el)
+	} else {
+		el = runLRU.PushFront(&runEntry{id: id, done: make(chan struct{})})
+		runCache[id] = el
+		for runLRU.Len() > maxCachedRuns {
+			// callers waiting for an evicted fetch still get its result
+			delete(runCache, runLRU.Remove(runLRU.Back()).(*runEntry).id)
+		}
 	}
+	e := el.Value.(*runEntry)
+	runCacheMu.Unlock()
 
-	path := filepath.Join(dest, f.Name)
+	if ok {
+		select {
+		case <-e.done:
+			return e.run, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 
-	// Check for ZipSlip (Directory traversal)
-	if !strings.HasPrefix(path, filepath.Clean(dest)+string(os.PathSeparator)) {
-		return fmt.Errorf("illegal file path: %s", path)
+	url := fmt.Sprintf("%s/actions/runs/%d", repoURL(j), id)
+	r := new(Run)
+	if err := getJSON(ctx, j, url, r); err != nil {
+		runCacheMu.Lock()
+		if runCache[id] == el {
+			delete(runCache, id)
+			runLRU.Remove(el)
+		}
+		runCacheMu.Unlock()
+		e.err = err
+	} else {
+		e.run = r
 	}
+	close(e.done)
+	return e.run, e.err
+}
 
-	if diff, err := hasDiff(b, path); err != nil {
-		return err
-	} else if !diff {
-		// log.Printf("[Info] No diff: %v\n", f.Name)
+func downloadArtifact(ctx context.Context, j Job, a *Artifact, filename string) error {
+	dest := filepath.Join(artifactsDir, filename+".zip")
+	if fromCache(a, dest) {
+		log.Printf("[Info] Job %v [%v]: artifact %v found in cache\n", filename, requestID(ctx), a.ID)
 		return nil
 	}
-	log.Printf("[Info] Extracting: %v\n", f.Name)
+	release, err := acquireDownload(ctx, jobKey(j))
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	os.MkdirAll(filepath.Dir(path), 0755)
-	t, err := os.CreateTemp(tempDir, "extract-*")
+	req, err := newRequest(ctx, j, a.ArchiveDownloadURL)
 	if err != nil {
 		return err
 	}
-	if _, err = io.Copy(t, b); err != nil {
+	switch {
+	case j.DownloadAccept != "":
+		req.Header.Set("Accept", j.DownloadAccept)
+	case j.Source == "release":
+		// the asset itself instead of its metadata
+		req.Header.Set("Accept", "application/octet-stream")
+	}
+	if j.DownloadChunks > 1 {
+		// only the first byte, to learn the size and whether the storage
+		// the download is redirected to supports ranges
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := sched.Do(ctx, j.Owner, req)
+	if err != nil {
 		return err
 	}
-	if err := t.Close(); err != nil {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound, http.StatusGone:
+		return fmt.Errorf("download artifact: %w: %v", errArtifactGone, resp.Status)
+	default:
+		return fmt.Errorf("download artifact: %v", resp.Status)
+	}
+
+	// write to file
+	file, err := os.CreateTemp(tempDir, "artifact-tmp-*")
+	if err != nil {
 		return err
 	}
-	if err := os.Chmod(t.Name(), 0644); err != nil {
+	h := sha256.New()
+	if resp.StatusCode == http.StatusPartialContent {
+		size, ok := contentLength(resp)
+		if !ok {
+			err = fmt.Errorf("download artifact: invalid Content-Range %q", resp.Header.Get("Content-Range"))
+		} else {
+			resp.Body.Close()
+			debugf("Job %v [%v]: downloading %d bytes in up to %d chunks\n", filename, requestID(ctx), size, j.DownloadChunks)
+			err = downloadChunks(ctx, resp.Request.URL.String(), size, j.DownloadChunks, file)
+		}
+		// hash the reassembled file
+		if err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(file, 0, size))
+		}
+	} else {
+		// a server without ranges sends the whole archive
+		_, err = io.Copy(io.MultiWriter(file, h), resp.Body)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
 		return err
 	}
-	if err := os.Rename(t.Name(), path); err != nil {
+	file.Close()
+	if d := "sha256:" + hex.EncodeToString(h.Sum(nil)); a.Digest != "" && d != a.Digest {
+		os.Remove(file.Name())
+		return fmt.Errorf("artifact digest mismatch: got %v, want %v", d, a.Digest)
+	}
+	if err := checkZip(file.Name()); err != nil {
+		os.Remove(file.Name())
 		return err
 	}
 
+	if err := os.Rename(file.Name(), dest); err != nil {
+		return err
+	}
+	addToCache(a, dest)
 	return nil
 }
 
-func hasDiff(b *bytes.Buffer, destFile string) (bool, error) {
-	// MurMurHash3 128-bit
-	mb := murmur3.New128()
-	if _, err := mb.Write(b.Bytes()); err != nil {
-		return false, err
+// unzipDiff extracts the files of the archive that differ
+// from the job's target and returns what was written.
+func unzipDiff(ctx context.Context, filename string, j Job, key string) (deploy.Result, error) {
+	opts, err := extractOptions(ctx, j)
+	if err != nil {
+		return deploy.Result{}, err
+	}
+	var dirs map[string]string
+	if j.SkipUnchangedDirs {
+		if dirs, err = deploy.DirHashes(filename, j.Excludes); err != nil {
+			return deploy.Result{}, err
+		}
+		opts.SkipDirs = unchangedDirs(key, j.DeployPath, dirs)
+		if len(opts.SkipDirs) > 0 {
+			debugf("Job %v [%v]: skipping unchanged directories %v\n", key, requestID(ctx), opts.SkipDirs)
+		}
+	}
+	res, err := deploy.ExtractZipDiff(ctx, filename, j.DeployPath, opts)
+	if err == nil && j.Verify {
+		err = verifyDeploy(ctx, filename, j, key, opts, res.Denied)
 	}
-	hashb := mb.Sum(nil) // result 1
+	if err == nil && res.Failed == 0 && dirs != nil {
+		err = recordDirHashes(key, j.DeployPath, dirs)
+	}
+	return res, err
+}
 
-	f, err := os.Open(destFile)
+// verifyDeploy checks that the files extracted to the job's deploy
+// path match the artifact, but for the denied ones skipped with
+// onPermissionDenied "skip".
+func verifyDeploy(ctx context.Context, filename string, j Job, key string, opts deploy.Options, denied []string) error {
+	bad, err := deploy.Verify(ctx, filename, j.DeployPath, opts, denied)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return true, nil
+		return fmt.Errorf("verify: %v", err)
+	}
+	if len(bad) > 0 {
+		for _, name := range bad {
+			log.Printf("[Error] Job %v [%v]: %v doesn't match the artifact\n", key, requestID(ctx), name)
 		}
-		return false, err
+		return fmt.Errorf("verify: %d files don't match the artifact", len(bad))
 	}
-	defer f.Close()
+	debugf("Job %v [%v]: verified %v\n", key, requestID(ctx), j.DeployPath)
+	return nil
+}
 
-	fb := murmur3.New128()
-	if _, err := io.Copy(fb, f); err != nil {
-		return false, err
+// jobModes returns the file and directory modes of the job's umask,
+// or 0 for the defaults.
+func jobModes(j Job) (os.FileMode, os.FileMode, error) {
+	if j.Umask == "" {
+		return 0, 0, nil
 	}
-	hashf := fb.Sum(nil) // result 2
-
-	return !bytes.Equal(hashb, hashf), nil
+	u, err := strconv.ParseUint(j.Umask, 8, 32)
+	if err != nil || u > 0777 {
+		return 0, 0, fmt.Errorf("invalid umask %q", j.Umask)
+	}
+	return 0666 &^ os.FileMode(u), 0777 &^ os.FileMode(u), nil
 }
 
-func pathMatches(p string, excludes []string) bool {
-	for _, e := range excludes {
-		if ok, _ := regexp.MatchString("^"+e+"$", p); ok {
-			return true
+// extractOptions maps the job's settings to extraction options. The
+// requests of a docker target are cancelled with ctx.
+func extractOptions(ctx context.Context, j Job) (deploy.Options, error) {
+	opts := deploy.Options{
+		Excludes:            j.Excludes,
+		StripRoot:           j.StripRoot,
+		SkipBinary:          j.SkipBinary,
+		AllowedTypes:        j.AllowedTypes,
+		MaxFileSize:         j.MaxFileSize,
+		MaxArchiveSize:      j.MaxArchiveSize,
+		FailOversize:        j.OnOversize == "fail",
+		AllowedExtensions:   j.AllowedExtensions,
+		FailDisallowed:      j.OnDisallowed == "fail",
+		OnDenied:            j.OnPermissionDenied,
+		MaxCompressionRatio: j.MaxCompressionRatio,
+		DiffMode:            j.DiffMode,
+		HashWidth:           j.HashWidth,
+		HashSeed:            j.HashSeed,
+		ExtractMode:         j.ExtractMode,
+		SkipDiff:            j.SkipDiff,
+		Phases:              j.Phases,
+		TempDir:             tempDir,
+		Logger:              log.Default(),
+		Debug:               *debug,
+		Sync:                j.Fsync,
+	}
+	var err error
+	if opts.FileMode, opts.DirMode, err = jobModes(j); err != nil {
+		return opts, err
+	}
+	for _, rw := range j.Rewrite {
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return opts, err
 		}
+		opts.Rewrites = append(opts.Rewrites, deploy.Rewrite{Match: re, Replace: rw.Replace})
+	}
+	if j.Target == "docker" {
+		t, err := newDockerTarget(ctx, j)
+		if err != nil {
+			return opts, err
+		}
+		opts.Target = t
+	}
+	return opts, nil
+}
+
+// printResult prints the result of a command to stdout, as JSON
+// with -json or using human otherwise. Logs stay on stderr.
+func printResult(v any, human func()) {
+	if !*jsonOutput {
+		human()
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
 	}
-	return false
 }
 
 func loadJSON(filename string, v any) error {
@@ -320,15 +1684,68 @@ func loadJSON(filename string, v any) error {
 	return json.NewDecoder(file).Decode(v)
 }
 
+// saveJSON atomically replaces filename with v encoded as JSON.
 func saveJSON(filename string, v any) error {
-	file, err := os.CreateTemp(tempDir, "tmp-*")
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// writeFileAtomic replaces filename with what write writes, in a temp
+// file next to it, or in tempDir for the working directory. The data is
+// synced to disk before the rename and the directory after it, so the
+// file is never empty or truncated even on power loss.
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	// files of other directories, e.g. of profiles, may be on another filesystem
+	dir := tempDir
+	if d := filepath.Dir(filename); d != "." {
+		dir = d
+	}
+	file, err := os.CreateTemp(dir, ".tmp-*")
 	if err != nil {
 		return err
 	}
-	if err := json.NewEncoder(file).Encode(v); err != nil {
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file.Name())
 		return err
 	}
-	file.Close()
 
-	return os.Rename(file.Name(), filename)
+	if err := os.Rename(file.Name(), filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return deploy.SyncDir(filepath.Dir(filename))
+}
+
+// cleanTemp removes temp files orphaned by a previous run that crashed,
+// including those writeFileAtomic left next to the files of profiles.
+func cleanTemp() {
+	es, err := os.ReadDir(tempDir)
+	if err != nil {
+		log.Printf("[Error] Clean temp: %v\n", err)
+		return
+	}
+	for _, e := range es {
+		if err := os.RemoveAll(filepath.Join(tempDir, e.Name())); err != nil {
+			log.Printf("[Error] Clean temp: %v\n", err)
+		}
+	}
+
+	for _, p := range configProfiles() {
+		for _, dir := range []string{p.path("."), p.path(stateDir)} {
+			names, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+			for _, name := range names {
+				if err := os.Remove(name); err != nil {
+					log.Printf("[Error] Clean temp: %v\n", err)
+				}
+			}
+		}
+	}
 }
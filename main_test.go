@@ -0,0 +1,231 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useState gives the test empty job statuses and state, and the jobs js.
+func useState(t *testing.T, js ...Job) {
+	t.Helper()
+	prevJobs, prevStatuses, prevRecords, prevUpdate := currentJobs(), statuses, records, lastUpdate
+	setJobs(js)
+	statuses = make(map[string]*JobStatus)
+	records = make(map[string]*Record)
+	lastUpdate = make(map[string]time.Time)
+	t.Cleanup(func() {
+		setJobs(prevJobs)
+		statuses, records, lastUpdate = prevStatuses, prevRecords, prevUpdate
+	})
+}
+
+// useWorkDir runs the test in a temp working directory with its
+// temp dir, where the state is saved.
+func useWorkDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// fakeGitHub serves an artifact list with as for the repo o/r and
+// fails every download.
+func fakeGitHub(t *testing.T, as ...Artifact) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/o/r/actions/artifacts" {
+			http.NotFound(w, r)
+			return
+		}
+		for i := range as {
+			as[i].ArchiveDownloadURL = "http://" + r.Host + "/download"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Artifacts{TotalCount: int64(len(as)), Artifacts: as})
+	}))
+	t.Cleanup(srv.Close)
+	useGitHub(t)
+	return srv
+}
+
+// useGitHub gives the owner o a token and lifts the rate limits,
+// which would wait on the fake clock.
+func useGitHub(t *testing.T) {
+	t.Helper()
+	prev, prevSched := currentSecrets(), sched
+	setSecrets(map[string]Secret{"o": {Owner: "o", Token: "t"}})
+	sched = &scheduler{global: newLimiter(0), owners: make(map[string]*limiter)}
+	t.Cleanup(func() { setSecrets(prev); sched = prevSched })
+}
+
+func TestSettle(t *testing.T) {
+	c := useFakeClock(t)
+	a := Artifact{ID: 1, Name: "dist", CreatedAt: c.Now()}
+	srv := fakeGitHub(t, a)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", APIURL: srv.URL, DeployPath: t.TempDir(), Settle: Duration{10 * time.Minute}}
+	key := jobKey(j)
+	useState(t, j)
+
+	for _, step := range []time.Duration{0, 5 * time.Minute, 4*time.Minute + 59*time.Second} {
+		c.Advance(step)
+		r, err := deployLatest(context.Background(), j, key, false)
+		if err != nil || r.Status != statusPending {
+			t.Fatalf("after %v: got %v, %v, want pending", step, r.Status, err)
+		}
+	}
+	if p := jobStatus(key).Pending; p == nil || p.Reason != "settling" || !p.Since.Equal(a.CreatedAt) {
+		t.Fatalf("pending %+v, want settling since %v", p, a.CreatedAt)
+	}
+
+	// settled, the deploy goes on to the download, which fails
+	c.Advance(time.Second)
+	if r, err := deployLatest(context.Background(), j, key, false); err == nil || r.Status == statusPending {
+		t.Fatalf("settled: got %v, %v, want a download error", r.Status, err)
+	}
+}
+
+// useRunCache gives the test an empty run cache.
+func useRunCache(t *testing.T) {
+	prev, prevLRU := runCache, runLRU
+	runCache, runLRU = make(map[int64]*list.Element), list.New()
+	t.Cleanup(func() { runCache, runLRU = prev, prevLRU })
+}
+
+func TestGetRun(t *testing.T) {
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/repos/o/r/actions/runs/1":
+			<-release
+			json.NewEncoder(w).Encode(Run{ID: 1, Name: "build"})
+		case "/repos/o/r/actions/runs/2":
+			json.NewEncoder(w).Encode(Run{ID: 2, Name: "test"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	useGitHub(t)
+	useRunCache(t)
+	j := Job{Owner: "o", Repo: "r", APIURL: srv.URL}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	runs := make([]*Run, 5)
+	for i := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := getRun(ctx, j, 1)
+			if err != nil {
+				t.Error(err)
+			}
+			runs[i] = r
+		}()
+	}
+
+	// other runs are fetched while run 1 is
+	if r, err := getRun(ctx, j, 2); err != nil || r.Name != "test" {
+		t.Fatalf("run 2: got %+v, %v", r, err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := getRun(cancelled, j, 1); err != context.Canceled {
+		t.Fatalf("waiting with a cancelled context: got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	for _, r := range runs {
+		if r == nil || r.Name != "build" {
+			t.Fatalf("run 1: got %+v", r)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times, want once per run", n)
+	}
+
+	// failed fetches aren't cached
+	for i := 0; i < 2; i++ {
+		if _, err := getRun(ctx, j, 3); err == nil {
+			t.Fatal("missing run: got no error")
+		}
+	}
+	if n := fetches.Load(); n != 4 {
+		t.Fatalf("fetched %d times, want the missing run twice", n)
+	}
+}
+
+func TestForceKeepsApproval(t *testing.T) {
+	t.Setenv("DEPLOYER_APPROVAL_SECRET", "s")
+	c := useFakeClock(t)
+	srv := fakeGitHub(t, Artifact{ID: 1, Name: "dist", CreatedAt: c.Now()})
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", APIURL: srv.URL, DeployPath: t.TempDir(), RequireApproval: true}
+	key := jobKey(j)
+	useState(t, j)
+
+	r, err := deployLatest(context.Background(), j, key, true)
+	if err != nil || r.Status != statusPending {
+		t.Fatalf("forced: got %v, %v, want pending", r.Status, err)
+	}
+	if p := jobStatus(key).Pending; p == nil || p.Reason != "awaiting approval" {
+		t.Fatalf("pending %+v, want awaiting approval", p)
+	}
+}
+
+func TestGetRunEvicts(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(Run{Name: r.URL.Path})
+	}))
+	t.Cleanup(srv.Close)
+	useGitHub(t)
+	useRunCache(t)
+	j := Job{Owner: "o", Repo: "r", APIURL: srv.URL}
+	ctx := context.Background()
+
+	for id := int64(1); id <= maxCachedRuns; id++ {
+		if _, err := getRun(ctx, j, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// used again, so run 2 is now the least recently used
+	getRun(ctx, j, 1)
+	getRun(ctx, j, maxCachedRuns+1)
+	if len(runCache) != maxCachedRuns || runLRU.Len() != maxCachedRuns {
+		t.Fatalf("cached %d runs, %d in the LRU list, want %d", len(runCache), runLRU.Len(), maxCachedRuns)
+	}
+	n := fetches.Load()
+	getRun(ctx, j, 1)
+	if fetches.Load() != n {
+		t.Error("refetched run 1, the recently used one")
+	}
+	getRun(ctx, j, 2)
+	if fetches.Load() != n+1 {
+		t.Error("run 2 wasn't evicted")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// maxManifestSize bounds the download of a manifest artifact.
+const maxManifestSize = 16 << 20
+
+// manifestDigest returns a digest of the manifest uploaded by the
+// artifact's run, which maps every file name of the artifact to its hash.
+// Equal digests mean the artifact deploys the same files.
+func manifestDigest(ctx context.Context, j Job, artifact *Artifact) (string, error) {
+	u := fmt.Sprintf("%s/actions/runs/%d/artifacts?name=%s",
+		repoURL(j), artifact.WorkflowRun.ID, url.QueryEscape(j.Manifest))
+	as := new(Artifacts)
+	if err := getJSON(ctx, j, u, as); err != nil {
+		return "", err
+	}
+	var m *Artifact
+	for i := range as.Artifacts {
+		if as.Artifacts[i].Name == j.Manifest && !as.Artifacts[i].Expired {
+			m = &as.Artifacts[i]
+			break
+		}
+	}
+	if m == nil {
+		return "", fmt.Errorf("manifest artifact %v not found in run %v", j.Manifest, artifact.WorkflowRun.ID)
+	}
+
+	req, err := newRequest(ctx, j, m.ArchiveDownloadURL)
+	if err != nil {
+		return "", err
+	}
+	resp, err := sched.Do(ctx, j.Owner, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download manifest: %v", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxManifestSize {
+		return "", fmt.Errorf("manifest artifact exceeds %d bytes", maxManifestSize)
+	}
+
+	files, err := readManifest(b)
+	if err != nil {
+		return "", err
+	}
+	// maps are encoded with sorted keys, so the digest
+	// doesn't depend on the order of the manifest
+	canon, err := json.Marshal(files)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(canon)
+	return "sha256:" + hex.EncodeToString(h[:]), nil
+}
+
+// readManifest decodes the single JSON file in a manifest artifact zip.
+func readManifest(b []byte) (map[string]string, error) {
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	var f *zip.File
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if f != nil {
+			return nil, errors.New("manifest artifact must contain a single file")
+		}
+		f = zf
+	}
+	if f == nil {
+		return nil, errors.New("manifest artifact is empty")
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	files := make(map[string]string)
+	if err := json.NewDecoder(rc).Decode(&files); err != nil {
+		return nil, fmt.Errorf("manifest %v: %v", f.Name, err)
+	}
+	return files, nil
+}
+
+// manifestUnchanged reports whether the manifest of the artifact matches
+// the last deploy, in which case the artifact is recorded as deployed
+// without downloading it. The manifest digest is returned for recording.
+// Manifest errors are logged and fall back to a full download.
+func manifestUnchanged(ctx context.Context, j Job, key string, artifact *Artifact) (string, bool, error) {
+	digest, err := manifestDigest(ctx, j, artifact)
+	if err != nil {
+		log.Printf("[Warn] Job %v [%v]: manifest: %v, doing a full download\n", key, requestID(ctx), err)
+		return "", false, nil
+	}
+	prev := lastDeploy(key)
+	if prev == nil || prev.Manifest != digest {
+		return digest, false, nil
+	}
+
+	log.Printf("[Info] Job %v [%v]: manifest of artifact %v unchanged, skipping download\n", key, requestID(ctx), artifact.ID)
+	err = markUpdate(key, artifact.CreatedAt)
+	clearPending(key)
+	if rerr := recordDeploy(key, Deploy{
+		ArtifactID: artifact.ID,
+		CreatedAt:  artifact.CreatedAt,
+		SHA:        artifact.WorkflowRun.HeadSHA,
+		DeployedAt: clock.Now(),
+		Files:      prev.Files,
+		Size:       prev.Size,
+		Manifest:   digest,
+	}); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("saving the state failed: %v", err)
+	}
+	return digest, true, nil
+}
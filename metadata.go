@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ObjectMetadata are the headers to store with uploaded files whose
+// names match Match, a glob matched against the whole name or, without
+// a slash, against the base name. Empty fields are left to later rules.
+type ObjectMetadata struct {
+	Match        string `json:"match"`
+	CacheControl string `json:"cacheControl,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+}
+
+// hashedName matches file names with a content hash, like app.3f2a9c1e.js,
+// which never change and can be cached forever.
+var hashedName = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^/]+$`)
+
+// defaultMetadata apply after the job's rules.
+var defaultMetadata = []ObjectMetadata{
+	{Match: "*.html", CacheControl: "no-cache"},
+	{Match: "*.json", CacheControl: "no-cache"},
+	{Match: "*.webmanifest", CacheControl: "no-cache"},
+	{Match: "sw.js", CacheControl: "no-cache"},
+}
+
+func validateMetadata(j Job) error {
+	for _, m := range j.Metadata {
+		if _, err := path.Match(m.Match, ""); err != nil || m.Match == "" {
+			return fmt.Errorf("invalid metadata match %q", m.Match)
+		}
+	}
+	return nil
+}
+
+func (m ObjectMetadata) matches(name string) bool {
+	if !strings.Contains(m.Match, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(m.Match, name)
+	return ok
+}
+
+// objectMetadata returns the cache-control and content-type headers
+// of a file: the first ones set by a matching rule of the job, then of
+// the defaults. Hashed names are cached for a year, other files for
+// an hour, and the content type is inferred from the extension.
+func objectMetadata(j Job, name string) (cacheControl, contentType string) {
+	for _, m := range append(j.Metadata[:len(j.Metadata):len(j.Metadata)], defaultMetadata...) {
+		if !m.matches(name) {
+			continue
+		}
+		if cacheControl == "" {
+			cacheControl = m.CacheControl
+		}
+		if contentType == "" {
+			contentType = m.ContentType
+		}
+	}
+	if cacheControl == "" {
+		cacheControl = "public, max-age=3600"
+		if hashedName.MatchString(name) {
+			cacheControl = "public, max-age=31536000, immutable"
+		}
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return cacheControl, contentType
+}
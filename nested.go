@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/action-deployer/deploy"
+)
+
+// maxNesting limits how many archives deep InnerArchive may reach.
+const maxNesting = 3
+
+func validateInnerArchive(j Job) error {
+	if j.InnerArchive == "" {
+		return nil
+	}
+	names := strings.Split(j.InnerArchive, "!")
+	if len(names) > maxNesting {
+		return fmt.Errorf("innerArchive is nested more than %d levels deep", maxNesting)
+	}
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("invalid innerArchive %q", j.InnerArchive)
+		}
+	}
+	return nil
+}
+
+// unwrapArchive replaces the downloaded archive at filename with the
+// zip it holds named by the job's InnerArchive, and so on for every
+// level of nesting, so it's deployed like any downloaded artifact.
+func unwrapArchive(j Job, filename string) error {
+	if j.InnerArchive == "" {
+		return nil
+	}
+	for _, name := range strings.Split(j.InnerArchive, "!") {
+		if err := extractInner(j, filename, name); err != nil {
+			return fmt.Errorf("inner archive %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// extractInner replaces the archive at filename with its entry name.
+func extractInner(j Job, filename, name string) error {
+	r, err := deploy.OpenZip(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var f *zip.File
+	for _, zf := range r.File {
+		if zf.Name == name {
+			f = zf
+			break
+		}
+	}
+	if f == nil {
+		return errors.New("not found in the artifact")
+	}
+	// the inner archive is written before any limit of the
+	// extraction applies, its own size is limited as a whole
+	if j.MaxArchiveSize > 0 && f.UncompressedSize64 > j.MaxArchiveSize {
+		return fmt.Errorf("exceeds max archive size (%d bytes)", j.MaxArchiveSize)
+	}
+	if err := checkFreeSpace(tempDir, f.UncompressedSize64); err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp(tempDir, "inner-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	_, err = io.Copy(tmp, rc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkZip(tmp.Name()); err != nil {
+		return err
+	}
+	r.Close()
+	return os.Rename(tmp.Name(), filename)
+}
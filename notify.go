@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	transitionFailing   = "failing"
+	transitionRecovered = "recovered"
+
+	notifyTimeout = time.Minute
+)
+
+func validateNotify(j Job) error {
+	if j.FailingAfter < 0 {
+		return errors.New("failingAfter is negative")
+	}
+	for _, c := range [][]string{j.OnFailing, j.OnRecovered} {
+		if len(c) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(c[0]); err != nil {
+			return fmt.Errorf("notify command: %v", err)
+		}
+	}
+	return nil
+}
+
+func (j Job) failingAfter() int {
+	if j.FailingAfter > 0 {
+		return j.FailingAfter
+	}
+	return 1
+}
+
+// notifyTransition logs that the job started failing or recovered,
+// instead of alerting on every run, and runs its OnFailing or
+// OnRecovered command. The command gets the job, the transition, the
+// consecutive failures and, when failing, the error of the last run.
+// A failing command is logged, it doesn't fail the run.
+func notifyTransition(ctx context.Context, j Job, key, transition string, failures int, runErr error) {
+	command := j.OnRecovered
+	if transition == transitionFailing {
+		command = j.OnFailing
+		log.Printf("[Warn] Job %v [%v]: failing after %d failed runs in a row\n", key, requestID(ctx), failures)
+	} else {
+		log.Printf("[Info] Job %v [%v]: recovered after %d failed runs in a row\n", key, requestID(ctx), failures)
+	}
+	if len(command) == 0 {
+		return
+	}
+
+	// the run may have been cut short by its timeout
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"DEPLOYER_JOB="+key,
+		"DEPLOYER_TRANSITION="+transition,
+		"DEPLOYER_FAILURES="+strconv.Itoa(failures),
+	)
+	if runErr != nil {
+		cmd.Env = append(cmd.Env, "DEPLOYER_ERROR="+runErr.Error())
+	}
+	if err := runLogged(ctx, key, cmd); err != nil {
+		log.Printf("[Error] Job %v [%v]: %v command %v: %v\n", key, requestID(ctx), transition, strings.Join(command, " "), err)
+	}
+}
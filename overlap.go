@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// workDirs returns the directories holding the deployer's own data,
+// which no deploy path may be in or contain.
+func workDirs(j Job) []string {
+	dirs := []string{tempDir, artifactsDir, cacheDir}
+	for _, p := range configProfiles() {
+		dirs = append(dirs, p.path(stateDir))
+	}
+	if j.SnapshotPath != "" {
+		dirs = append(dirs, j.SnapshotPath)
+	}
+	return dirs
+}
+
+// validatePaths fails if a deploy path of the job is, contains or is
+// inside one of the deployer's own directories, where a deploy would
+// write into its temp files or delete its downloads and state.
+func validatePaths(j Job) error {
+	if j.Target == "docker" {
+		// the deploy path is inside the container
+		return nil
+	}
+	for _, tj := range destinations(j) {
+		dest := deployRoot(tj.DeployPath)
+		for _, dir := range workDirs(j) {
+			if pathsOverlap(dest, dir) {
+				return fmt.Errorf("deployPath %v overlaps %v, which the deployer uses for its own files", tj.DeployPath, realPath(dir))
+			}
+		}
+	}
+	return nil
+}
+
+// pathsOverlap reports whether a and b are the same directory
+// or one is inside the other.
+func pathsOverlap(a, b string) bool {
+	a, b = realPath(a), realPath(b)
+	return within(a, b) || within(b, a)
+}
+
+// within reports whether path is dir or inside it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// realPath returns p as an absolute path with its symlinks
+// resolved, as far as it exists.
+func realPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+	if r, err := filepath.EvalSymlinks(abs); err == nil {
+		return r
+	}
+	// resolve the existing parent of a path yet to be created
+	if dir := filepath.Dir(abs); dir != abs {
+		return filepath.Join(realPath(dir), filepath.Base(abs))
+	}
+	return abs
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Branch struct {
+	Name string `json:"name"`
+}
+
+// trackPreview records that the deploy path for branch was created
+// by the deployer, so it may be removed once the branch is deleted.
+func trackPreview(key, branch, path string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	r := jobRecord(key)
+	if r.PreviewPaths == nil {
+		r.PreviewPaths = make(map[string]string)
+	}
+	if b, ok := r.PreviewPaths[path]; ok && b == branch {
+		return nil
+	}
+	r.PreviewPaths[path] = branch
+	return saveRecords(key)
+}
+
+// listBranches returns the names of all branches of the job's repo.
+func listBranches(ctx context.Context, j Job) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/branches?per_page=100&page=%d", repoURL(j), page)
+		var bs []Branch
+		if err := getJSON(ctx, j, url, &bs); err != nil {
+			return nil, err
+		}
+		for _, b := range bs {
+			names[b.Name] = true
+		}
+		if len(bs) < 100 {
+			return names, nil
+		}
+	}
+}
+
+// cleanupPreviews removes the preview deploys created for branches
+// that no longer exist. Only paths recorded by trackPreview are removed,
+// and not while an existing branch deploys to the same path, as
+// branches like feature/x and feature-x do.
+func cleanupPreviews(ctx context.Context, j Job, key string) error {
+	stateMu.Lock()
+	previews := make(map[string]string) // path -> branch
+	if r, ok := records[key]; ok {
+		for b, p := range r.Previews {
+			previews[p] = b
+		}
+		for p, b := range r.PreviewPaths {
+			previews[p] = b
+		}
+	}
+	stateMu.Unlock()
+	if len(previews) == 0 {
+		return nil
+	}
+
+	branches, err := listBranches(ctx, j)
+	if err != nil {
+		return err
+	}
+	if len(branches) == 0 {
+		// a repo always has a branch, don't trust an empty list
+		return nil
+	}
+	segments := make(map[string]bool, len(branches))
+	for b := range branches {
+		segments[pathSegment(b)] = true
+	}
+
+	root := filepath.Clean(deployRoot(j.DeployPath))
+	for p, b := range previews {
+		if branches[b] {
+			continue
+		}
+		if segments[pathSegment(b)] {
+			debugf("Job %v: keeping preview %v of deleted branch %v, an existing branch deploys to the same path\n", key, p, b)
+			continue
+		}
+		if !strings.HasPrefix(filepath.Clean(p), root+string(os.PathSeparator)) {
+			log.Printf("[Warn] Job %v: not removing preview %v outside of %v\n", key, p, root)
+			continue
+		}
+		log.Printf("[Info] Job %v: removing preview %v of deleted branch %v\n", key, p, b)
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+
+		stateMu.Lock()
+		r := jobRecord(key)
+		delete(r.PreviewPaths, p)
+		if r.Previews[b] == p {
+			delete(r.Previews, b)
+		}
+		err := saveRecords(key)
+		stateMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanupPreviews(t *testing.T) {
+	useWorkDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/o/r/branches" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]Branch{{Name: "main"}, {Name: "feature-x"}})
+	}))
+	t.Cleanup(srv.Close)
+	useGitHub(t)
+	root := t.TempDir()
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", APIURL: srv.URL, DeployPath: filepath.Join(root, "{branch}", "{short_sha}"), CleanupPreviews: true}
+	key := jobKey(j)
+	useState(t, j)
+
+	paths := map[string]string{
+		filepath.Join(root, "main", "aaaaaaa"):      "main",
+		filepath.Join(root, "feature-x", "bbbbbbb"): "feature/x", // deleted, but feature-x deploys there
+		filepath.Join(root, "old", "ccccccc"):       "old",
+		filepath.Join(root, "old", "ddddddd"):       "old",
+	}
+	for p, b := range paths {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := trackPreview(key, b, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy := filepath.Join(root, "legacy", "eeeeeee")
+	os.MkdirAll(legacy, 0755)
+	jobRecord(key).Previews = map[string]string{"legacy": legacy}
+
+	if err := cleanupPreviews(context.Background(), j, key); err != nil {
+		t.Fatal(err)
+	}
+	for p, b := range paths {
+		_, err := os.Stat(p)
+		if kept := err == nil; kept != (b != "old") {
+			t.Errorf("%v of %v: kept %v", p, b, kept)
+		}
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		t.Errorf("kept legacy preview %v", legacy)
+	}
+	r := jobRecord(key)
+	if len(r.PreviewPaths) != 2 || len(r.Previews) != 0 {
+		t.Errorf("records left %v, %v", r.PreviewPaths, r.Previews)
+	}
+}
+
+func TestExpandDeployPathFork(t *testing.T) {
+	a := &Artifact{ID: 1, WorkflowRun: WorkflowRun{RepositoryID: 1, HeadRepositoryID: 2, HeadBranch: "main", HeadSHA: "abc"}}
+	if p, err := expandDeployPath("/srv/previews/{branch}", a); err == nil {
+		t.Fatalf("fork deployed to %v", p)
+	}
+	if _, err := expandDeployPath("/srv/previews/{sha}", a); err != nil {
+		t.Fatalf("without {branch}: %v", err)
+	}
+	a.WorkflowRun.HeadRepositoryID = 1
+	if p, err := expandDeployPath("/srv/previews/{branch}", a); err != nil || p != "/srv/previews/main" {
+		t.Fatalf("same repo: got %v, %v", p, err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultInterval = 5 * time.Minute
+
+var profilesFile = flag.String("profiles", "", "file listing the config profiles to run in this process instead of the config in the working directory")
+
+// Profile is an isolated set of jobs and secrets, loaded from the job
+// and secret files in Dir, which also holds its state. Its job keys
+// are prefixed with "Name:".
+type Profile struct {
+	Name     string   `json:"name"`
+	Dir      string   `json:"dir"`
+	Interval Duration `json:"interval,omitempty"` // between polls, default 5m
+}
+
+var profiles []Profile // -profiles, empty for the working directory only
+
+func loadProfiles() error {
+	if *profilesFile == "" {
+		return nil
+	}
+	if *configURL != "" || *secretURL != "" {
+		return errors.New("-profiles can't be combined with -config-url or -secret-url")
+	}
+	var ps []Profile
+	if err := loadConfig(*profilesFile, &ps); err != nil {
+		return err
+	}
+	if len(ps) == 0 {
+		return fmt.Errorf("%v: no profiles", *profilesFile)
+	}
+	seen := make(map[string]bool)
+	for _, p := range ps {
+		if p.Name == "" || strings.ContainsAny(p.Name, ":/\\") {
+			return fmt.Errorf("invalid profile name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate profile %v", p.Name)
+		}
+		seen[p.Name] = true
+		if fi, err := os.Stat(p.Dir); err != nil {
+			return fmt.Errorf("profile %v: %v", p.Name, err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("profile %v: %v is not a directory", p.Name, p.Dir)
+		}
+		if p.Interval.Duration < 0 {
+			return fmt.Errorf("profile %v: negative interval", p.Name)
+		}
+	}
+	profiles = ps
+	return nil
+}
+
+// configProfiles returns the profiles to load, without -profiles
+// a single unnamed one in the working directory.
+func configProfiles() []Profile {
+	if len(profiles) == 0 {
+		return []Profile{{}}
+	}
+	return profiles
+}
+
+func (p Profile) path(filename string) string {
+	return filepath.Join(p.Dir, filename)
+}
+
+func (p Profile) interval() time.Duration {
+	if p.Interval.Duration > 0 {
+		return p.Interval.Duration
+	}
+	return defaultInterval
+}
+
+// profileInterval returns the poll interval of the profile with name.
+func profileInterval(name string) time.Duration {
+	for _, p := range configProfiles() {
+		if p.Name == name {
+			return p.interval()
+		}
+	}
+	return defaultInterval
+}
+
+// profilePrefix is the prefix of the job keys and secrets of a profile.
+func profilePrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + ":"
+}
+
+// localKey returns key without the prefix of the profile,
+// and whether it's the key of one of its jobs.
+func (p Profile) localKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, profilePrefix(p.Name))
+	return rest, ok && !strings.Contains(rest, ":")
+}
+
+// loadProfiled merges filename of every profile into m, keyed by job
+// key. Missing files are skipped, corrupt ones moved aside.
+func loadProfiled[V any](filename string, m map[string]V) error {
+	for _, p := range configProfiles() {
+		name := p.path(filename)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			continue
+		}
+		sub := make(map[string]V)
+		if ok, err := loadState(name, &sub); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		for k, v := range sub {
+			m[profilePrefix(p.Name)+k] = v
+		}
+	}
+	return nil
+}
+
+// saveProfiled writes the entries of m, keyed by job key, to filename
+// in the directory of their profile.
+func saveProfiled[V any](filename string, m map[string]V) error {
+	for _, p := range configProfiles() {
+		sub := make(map[string]V)
+		for k, v := range m {
+			if rest, ok := p.localKey(k); ok {
+				sub[rest] = v
+			}
+		}
+		if err := saveJSON(p.path(filename), sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollSchedule tracks when each profile is due for its next poll.
+type pollSchedule map[string]time.Time
+
+// due returns the jobs of the profiles due at now, or of all of them,
+// and schedules their next poll. Jobs backing off are left out until
+// their next poll, unless all are due.
+func (s pollSchedule) due(now time.Time, all bool) []Job {
+	var js []Job
+	for _, p := range configProfiles() {
+		if next, ok := s[p.Name]; ok && now.Before(next) && !all {
+			continue
+		}
+		s[p.Name] = now.Add(p.interval())
+		for _, j := range currentJobs() {
+			if j.Profile == p.Name && (all || !backingOff(j, now)) {
+				js = append(js, j)
+			}
+		}
+	}
+	return js
+}
+
+// postpone schedules the first poll of every profile one interval after now.
+func (s pollSchedule) postpone(now time.Time) {
+	for _, p := range configProfiles() {
+		s[p.Name] = now.Add(p.interval())
+	}
+}
+
+// wait returns how long until the next profile is due.
+func (s pollSchedule) wait(now time.Time) time.Duration {
+	d := defaultInterval
+	for i, p := range configProfiles() {
+		w := s[p.Name].Sub(now)
+		if i == 0 || w < d {
+			d = w
+		}
+	}
+	return max(d, 0)
+}
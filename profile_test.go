@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollSchedule(t *testing.T) {
+	c := useFakeClock(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist"}
+	useState(t, j)
+	s := make(pollSchedule)
+
+	if js := s.due(c.Now(), false); len(js) != 1 {
+		t.Fatalf("first poll: %d jobs due, want 1", len(js))
+	}
+	c.Advance(time.Minute)
+	if js := s.due(c.Now(), false); len(js) != 0 {
+		t.Fatalf("after 1m: %d jobs due, want 0", len(js))
+	}
+	if w := s.wait(c.Now()); w != defaultInterval-time.Minute {
+		t.Fatalf("wait %v, want %v", w, defaultInterval-time.Minute)
+	}
+	if js := s.due(c.Now(), true); len(js) != 1 {
+		t.Fatalf("woken: %d jobs due, want 1", len(js))
+	}
+	c.Advance(defaultInterval)
+	if js := s.due(c.Now(), false); len(js) != 1 {
+		t.Fatalf("after an interval: %d jobs due, want 1", len(js))
+	}
+}
+
+func TestPollSchedulePostpone(t *testing.T) {
+	c := useFakeClock(t)
+	useState(t, Job{Owner: "o", Repo: "r", ArtifactName: "dist"})
+	s := make(pollSchedule)
+	s.postpone(c.Now())
+
+	if js := s.due(c.Now(), false); len(js) != 0 {
+		t.Fatalf("%d jobs due on start, want 0", len(js))
+	}
+	if w := s.wait(c.Now()); w != defaultInterval {
+		t.Fatalf("wait %v, want %v", w, defaultInterval)
+	}
+	c.Advance(defaultInterval)
+	if js := s.due(c.Now(), false); len(js) != 1 {
+		t.Fatalf("%d jobs due after an interval, want 1", len(js))
+	}
+}
+
+func TestPollScheduleBackingOff(t *testing.T) {
+	c := useFakeClock(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", MissingBackoff: Duration{time.Hour}}
+	useState(t, j)
+	s := make(pollSchedule)
+	backoff(j, jobKey(j), true)
+	backoff(j, jobKey(j), true) // next poll in 20m
+
+	c.Advance(defaultInterval)
+	if js := s.due(c.Now(), false); len(js) != 0 {
+		t.Fatalf("%d jobs due while backing off, want 0", len(js))
+	}
+	if js := s.due(c.Now(), true); len(js) != 1 {
+		t.Fatalf("%d jobs due when all are, want 1", len(js))
+	}
+	c.Advance(15 * time.Minute)
+	if js := s.due(c.Now(), false); len(js) != 1 {
+		t.Fatalf("%d jobs due once backed off, want 1", len(js))
+	}
+}
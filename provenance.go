@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Provenance is the job and artifact that last wrote a deployed file.
+type Provenance struct {
+	File       string `json:"file"`
+	Job        string `json:"job,omitempty"`
+	ArtifactID int64  `json:"artifactId,omitempty"`
+}
+
+// recordProvenance records that the artifact with id wrote the files
+// named written into the deploy path of j. Files another job wrote
+// or another target of this job wrote last are logged as conflicts and
+// move to this target, so each file is recorded where it was last written. Docker targets
+// aren't tracked, their paths are inside the container.
+func recordProvenance(ctx context.Context, j Job, key string, id int64, written []string) error {
+	if j.Target == "docker" || len(written) == 0 {
+		return nil
+	}
+	root := realPath(j.DeployPath)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var others []string
+	for k, r := range records {
+		var taken []string
+		var last int64
+		for dir, files := range r.Files {
+			// overlapping targets of the same job conflict too
+			if k == key && dir == root || !pathsOverlap(root, dir) {
+				continue
+			}
+			for _, name := range written {
+				rel, err := filepath.Rel(dir, filepath.Join(root, filepath.FromSlash(name)))
+				if err != nil {
+					continue
+				}
+				if a, ok := files[filepath.ToSlash(rel)]; ok {
+					taken = append(taken, name)
+					last = a
+					delete(files, filepath.ToSlash(rel))
+				}
+			}
+		}
+		if len(taken) > 0 {
+			slices.Sort(taken)
+			log.Printf("[Warn] Job %v [%v]: %v: overwrote %d files last deployed by job %v (artifact %v), e.g. %v. Their deploy paths overlap\n", key, requestID(ctx), root, len(taken), k, last, taken[0])
+			if k != key {
+				others = append(others, k)
+			}
+		}
+	}
+
+	r := jobRecord(key)
+	if r.Files == nil {
+		r.Files = make(map[string]map[string]int64)
+	}
+	if r.Files[root] == nil {
+		r.Files[root] = make(map[string]int64)
+	}
+	for _, name := range written {
+		r.Files[root][name] = id
+	}
+	if *perJobState {
+		// otherwise saved with the job's record
+		for _, k := range others {
+			if err := saveRecords(k); err != nil {
+				return err
+			}
+		}
+	}
+	return saveRecords(key)
+}
+
+// fileProvenance returns the job and artifact that last wrote the
+// deployed file at path, with an empty Job if none did.
+// The caller must hold stateMu.
+func fileProvenance(path string) Provenance {
+	abs := realPath(path)
+	p := Provenance{File: path}
+	for k, r := range records {
+		for dir, files := range r.Files {
+			rel, err := filepath.Rel(dir, abs)
+			if err != nil || !within(abs, dir) {
+				continue
+			}
+			if id, ok := files[filepath.ToSlash(rel)]; ok {
+				p.Job, p.ArtifactID = k, id
+				return p
+			}
+		}
+	}
+	return p
+}
+
+// runWhich prints the job and artifact that last deployed each of files.
+func runWhich(files []string) bool {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: which <file>...")
+		return false
+	}
+	stateMu.Lock()
+	ps := make([]Provenance, 0, len(files))
+	for _, f := range files {
+		ps = append(ps, fileProvenance(f))
+	}
+	stateMu.Unlock()
+
+	ok := true
+	for _, p := range ps {
+		if p.Job == "" {
+			ok = false
+		}
+	}
+	printResult(ps, func() {
+		for _, p := range ps {
+			if p.Job == "" {
+				fmt.Printf("%v: not deployed by any job\n", p.File)
+				continue
+			}
+			fmt.Printf("%v: job %v, artifact %v\n", p.File, p.Job, p.ArtifactID)
+		}
+	})
+	return ok
+}
+
+// warnOverlaps logs the jobs whose deploy paths overlap, whose
+// deploys may overwrite each other's files.
+func warnOverlaps() {
+	type dest struct{ key, path string }
+	var ds []dest
+	for _, j := range currentJobs() {
+		if j.Target == "docker" {
+			continue
+		}
+		for _, tj := range destinations(j) {
+			if !isTemplate(tj.DeployPath) {
+				ds = append(ds, dest{jobKey(j), tj.DeployPath})
+			}
+		}
+	}
+	for i, a := range ds {
+		for _, b := range ds[i+1:] {
+			if a.key != b.key && pathsOverlap(a.path, b.path) {
+				log.Printf("[Warn] Job %v: deployPath %v overlaps deployPath %v of job %v, their deploys may overwrite each other's files\n", a.key, a.path, b.path, b.key)
+			}
+		}
+	}
+}
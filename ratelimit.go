@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var rateLimitWarn = flag.Int("rate-limit-warn", 500, "warn when an owner's remaining GitHub rate limit drops below this, 0 to disable")
+
+// RateLimit is GitHub's rate limit budget as of the latest response.
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+var (
+	rateMu     sync.Mutex
+	rateLimits = make(map[string]*RateLimit) // owner -> budget
+)
+
+// recordRateLimit keeps the budget reported in a response to a request
+// of owner, warning once per window when it runs low. Responses without
+// rate limit headers, like redirected downloads, are ignored.
+func recordRateLimit(owner string, h http.Header) {
+	limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	var reset time.Time
+	if n, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		reset = time.Unix(n, 0)
+	}
+
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	prev := rateLimits[owner]
+	rateLimits[owner] = &RateLimit{Limit: limit, Remaining: remaining, Reset: reset}
+	// warn on crossing the threshold, or on the first response of a new window
+	low := remaining < *rateLimitWarn
+	wasLow := prev != nil && prev.Reset.Equal(reset) && prev.Remaining < *rateLimitWarn
+	if low && !wasLow {
+		log.Printf("[Warn] GitHub rate limit of %v low: %d of %d requests left until %v\n",
+			owner, remaining, limit, reset.Format(time.TimeOnly))
+	}
+}
+
+// rateLimitFor returns a copy of the latest budget of owner, or nil.
+func rateLimitFor(owner string) *RateLimit {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	if r, ok := rateLimits[owner]; ok {
+		rl := *r
+		return &rl
+	}
+	return nil
+}
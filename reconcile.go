@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+var reconcileFlag = flag.Bool("reconcile", false, "redeploy the recorded artifact of every job on startup")
+
+// reconcileJobs re-extracts the last deployed artifact of every job, so
+// a wiped or modified deploy path matches the recorded state again.
+// Only missing or changed files are written.
+func reconcileJobs(ctx context.Context) {
+	for _, j := range currentJobs() {
+		if ctx.Err() != nil {
+			return
+		}
+		key := jobKey(j)
+		ctx := withRequestID(ctx, newRequestID())
+		n, err := reconcile(ctx, j, key)
+		switch {
+		case errors.Is(err, errNothingDeployed):
+			log.Printf("[Info] Job %v [%v]: nothing to reconcile, no deploy recorded\n", key, requestID(ctx))
+		case err != nil:
+			log.Printf("[Error] Job %v [%v]: reconcile: %v\n", key, requestID(ctx), err)
+		default:
+			log.Printf("[Info] Job %v [%v]: reconciled, %d files written\n", key, requestID(ctx), n)
+		}
+	}
+}
+
+var errNothingDeployed = errors.New("no deploy recorded")
+
+func reconcile(ctx context.Context, j Job, key string) (int, error) {
+	d := lastDeploy(key)
+	if d == nil {
+		return 0, errNothingDeployed
+	}
+	// the recorded id is of a release asset with source release
+	var artifact *Artifact
+	var err error
+	if j.Source == "release" {
+		artifact, err = getReleaseAsset(ctx, j, d.ArtifactID)
+	} else {
+		artifact = new(Artifact)
+		err = getJSON(ctx, j, fmt.Sprintf("%s/actions/artifacts/%d", repoURL(j), d.ArtifactID), artifact)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := downloadArtifact(ctx, j, artifact, key); err != nil {
+		return 0, err
+	}
+	if j.VerifyAttestation {
+		if err := verifyAttestation(ctx, j, filepath.Join(artifactsDir, key+".zip")); err != nil {
+			return 0, err
+		}
+	}
+	if err := unwrapArchive(j, filepath.Join(artifactsDir, key+".zip")); err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	files := 0
+	for _, tj := range destinations(j) {
+		// diff every file, the deployed tree may have changed
+		tj.SkipUnchangedDirs = false
+		r, err := deployTarget(ctx, tj, key, filepath.Join(artifactsDir, key+".zip"), artifact)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target %v: %v", tj.DeployPath, err))
+			continue
+		}
+		files += r.Files
+	}
+	return files, errors.Join(errs...)
+}
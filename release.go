@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Release struct {
+	ID              int64          `json:"id"`
+	TagName         string         `json:"tag_name"`
+	Name            string         `json:"name"`
+	TargetCommitish string         `json:"target_commitish"`
+	Draft           bool           `json:"draft"`
+	Prerelease      bool           `json:"prerelease"`
+	CreatedAt       time.Time      `json:"created_at"`
+	PublishedAt     time.Time      `json:"published_at"`
+	Assets          []ReleaseAsset `json:"assets"`
+}
+
+type ReleaseAsset struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	DownloadURL string    `json:"browser_download_url"` // .../releases/download/<tag>/<name>
+	Size        int64     `json:"size"`
+	Digest      string    `json:"digest"` // sha256:<hex>, if known
+	ContentType string    `json:"content_type"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// selectReleaseAsset returns the newest asset of the job's release,
+// the latest one unless a tag is set, matching artifactName as a glob
+// and not in skip. The asset is returned as an artifact so it goes
+// through the same download and extraction as one.
+func selectReleaseAsset(ctx context.Context, j Job, skip map[int64]bool) (*Artifact, error) {
+	u := repoURL(j) + "/releases/latest"
+	if j.Tag != "" {
+		u = fmt.Sprintf("%s/releases/tags/%s", repoURL(j), url.PathEscape(j.Tag))
+	}
+	r := new(Release)
+	if err := getJSON(ctx, j, u, r); err != nil {
+		return nil, err
+	}
+
+	// newest first, in case several assets match
+	slices.SortFunc(r.Assets, func(a, b ReleaseAsset) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	for _, a := range r.Assets {
+		pattern, name := j.ArtifactName, a.Name
+		if j.CaseInsensitiveName {
+			pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+		}
+		if ok, _ := path.Match(pattern, name); !ok {
+			continue
+		}
+		if a.State != "uploaded" || skip[a.ID] {
+			continue
+		}
+		return a.artifact(r.TagName), nil
+	}
+	return nil, errNoArtifact
+}
+
+// artifact returns the asset of the release tagged tag as an artifact.
+func (a ReleaseAsset) artifact(tag string) *Artifact {
+	return &Artifact{
+		ID:                 a.ID,
+		Name:               a.Name,
+		SizeInBytes:        a.Size,
+		Digest:             a.Digest,
+		URL:                a.URL,
+		ArchiveDownloadURL: a.URL,
+		CreatedAt:          a.CreatedAt,
+		UpdatedAt:          a.UpdatedAt,
+		WorkflowRun:        WorkflowRun{HeadBranch: tag},
+	}
+}
+
+// getReleaseAsset returns the release asset with id as an artifact,
+// e.g. the one recorded as deployed.
+func getReleaseAsset(ctx context.Context, j Job, id int64) (*Artifact, error) {
+	a := new(ReleaseAsset)
+	if err := getJSON(ctx, j, fmt.Sprintf("%s/releases/assets/%d", repoURL(j), id), a); err != nil {
+		return nil, err
+	}
+	// the tag of its release is only in the download URL
+	_, rest, _ := strings.Cut(a.DownloadURL, "/releases/download/")
+	tag, _, _ := strings.Cut(rest, "/")
+	if t, err := url.PathUnescape(tag); err == nil {
+		tag = t
+	}
+	return a.artifact(tag), nil
+}
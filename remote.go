@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// last fetched remote configs, used when the endpoint is unreachable
+	remoteJobFile    = "job.remote.json"
+	remoteSecretFile = "secret.remote.json"
+)
+
+var (
+	configURL     = flag.String("config-url", "", "fetch the jobs from this URL instead of the job file")
+	secretURL     = flag.String("secret-url", "", "fetch the secrets from this URL instead of the secret file")
+	configCA      = flag.String("config-ca", "", "PEM file of CA certificates trusted for -config-url and -secret-url")
+	configRefresh = flag.Duration("config-refresh", 0, "refetch the remote config this often, 0 to only fetch it on startup")
+)
+
+// loadRemoteConfig fetches a JSON or YAML config from url into v. The
+// response is cached in cacheFile, which is used instead if the fetch
+// fails. A bearer token is sent from $DEPLOYER_CONFIG_TOKEN if set,
+// only over https.
+func loadRemoteConfig(url, cacheFile string, v any) error {
+	b, err := fetchRemoteConfig(url)
+	if err == nil {
+		if err = decodeConfig(b, v); err == nil {
+			if err := writeFileAtomic(cacheFile, func(w io.Writer) error {
+				_, err := w.Write(b)
+				return err
+			}); err != nil {
+				log.Printf("[Warn] Cache remote config: %v\n", err)
+			}
+			return nil
+		}
+	}
+
+	cached, cerr := os.ReadFile(cacheFile)
+	if cerr != nil {
+		return fmt.Errorf("remote config %v: %v", url, err)
+	}
+	log.Printf("[Warn] Remote config %v: %v, using the cached copy\n", url, err)
+	return decodeConfig(cached, v)
+}
+
+func fetchRemoteConfig(url string) ([]byte, error) {
+	c, err := remoteClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", *userAgent)
+	if t := os.Getenv("DEPLOYER_CONFIG_TOKEN"); t != "" {
+		if req.URL.Scheme != "https" {
+			return nil, errors.New("$DEPLOYER_CONFIG_TOKEN is only sent over https")
+		}
+		req.Header.Set("Authorization", "Bearer "+t)
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errors.New("$DEPLOYER_CONFIG_TOKEN is only sent over https, not following a redirect to " + req.URL.Redacted())
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+}
+
+func remoteClient() (*http.Client, error) {
+	c := &http.Client{Timeout: 30 * time.Second}
+	if *configCA == "" {
+		return c, nil
+	}
+	pem, err := os.ReadFile(*configCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %v", *configCA)
+	}
+	c.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return c, nil
+}
+
+// refreshConfig reloads the jobs and secrets between poll cycles.
+// The new config is only used if every job in it is valid.
+func refreshConfig() {
+	secrets, err := loadSecrets()
+	if err != nil {
+		log.Printf("[Error] Refresh config: %v\n", err)
+		return
+	}
+	js, err := loadJobs()
+	if err != nil {
+		log.Printf("[Error] Refresh config: %v\n", err)
+		return
+	}
+
+	// the jobs are validated against the new secrets
+	prevSecrets := currentSecrets()
+	setSecrets(secrets)
+	for _, j := range js {
+		if err := prepareJob(j); err != nil {
+			log.Printf("[Error] Refresh config: job %v: %v, keeping the current config\n", jobKey(j), err)
+			setSecrets(prevSecrets)
+			return
+		}
+	}
+	setJobs(js)
+	forgetTokens()
+	log.Printf("[Info] Config refreshed: %d jobs\n", len(js))
+}
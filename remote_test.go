@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRemoteConfigToken(t *testing.T) {
+	useWorkDir(t)
+	t.Setenv("DEPLOYER_CONFIG_TOKEN", "t")
+	var auth []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Write([]byte(`[{"owner": "o", "repo": "r", "artifactName": "dist", "deployPath": "/srv/www"}]`))
+	})
+
+	plain := httptest.NewServer(handler)
+	t.Cleanup(plain.Close)
+	var js []Job
+	if err := loadRemoteConfig(plain.URL, remoteJobFile, &js); err == nil || !strings.Contains(err.Error(), "only sent over https") {
+		t.Fatalf("over http: got %v", err)
+	}
+	if len(auth) > 0 {
+		t.Fatalf("the token was sent over http: %v", auth)
+	}
+
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := *configCA
+	*configCA = ca
+	t.Cleanup(func() { *configCA = prev })
+	if err := loadRemoteConfig(srv.URL, remoteJobFile, &js); err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != 1 || len(auth) != 1 || auth[0] != "Bearer t" {
+		t.Fatalf("got jobs %+v with auth %v", js, auth)
+	}
+	if b, err := os.ReadFile(remoteJobFile); err != nil || !strings.Contains(string(b), `"artifactName": "dist"`) {
+		t.Fatalf("cache holds %q, %v", b, err)
+	}
+	if es, _ := filepath.Glob(filepath.Join(tempDir, ".tmp-*")); len(es) > 0 {
+		t.Fatalf("caching left %v", es)
+	}
+
+	// redirected to http
+	redirect := httptest.NewTLSServer(http.RedirectHandler(plain.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: redirect.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchRemoteConfig(redirect.URL); err == nil || !strings.Contains(err.Error(), "redirect") {
+		t.Fatalf("redirected to http: got %v", err)
+	}
+	if len(auth) != 1 {
+		t.Fatalf("the token was sent after a redirect to http: %v", auth)
+	}
+}
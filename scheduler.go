@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	globalRate = flag.Float64("rate", 10, "max GitHub requests per second across all jobs, 0 for unlimited")
+	ownerRate  = flag.Float64("owner-rate", 0, "max GitHub requests per second per owner, 0 for unlimited")
+	retries    = flag.Int("retries", 3, "retries of a failed GitHub request")
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// limiter spaces out events to at most one per interval.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perSecond float64) *limiter {
+	if perSecond <= 0 {
+		return &limiter{}
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+func (l *limiter) Wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := clock.Now()
+	t := l.next
+	if t.Before(now) {
+		t = now
+	}
+	l.next = t.Add(l.interval)
+	l.mu.Unlock()
+	return sleepCtx(ctx, t.Sub(now))
+}
+
+// delay blocks the limiter until t, e.g. when a rate limit is exhausted.
+func (l *limiter) delay(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.next) {
+		l.next = t
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(d):
+		return nil
+	}
+}
+
+// scheduler is the single path for GitHub requests of all jobs. It
+// enforces the global and per-owner rate limits and retries failed
+// requests with exponential backoff, honoring GitHub's rate limit headers.
+type scheduler struct {
+	global *limiter
+
+	mu     sync.Mutex
+	owners map[string]*limiter
+}
+
+var sched = &scheduler{owners: make(map[string]*limiter)}
+
+func (s *scheduler) ownerLimiter(owner string) *limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.global == nil {
+		s.global = newLimiter(*globalRate)
+	}
+	l, ok := s.owners[owner]
+	if !ok {
+		l = newLimiter(*ownerRate)
+		s.owners[owner] = l
+	}
+	return l
+}
+
+// Do sends a bodiless request on behalf of owner. The caller must close
+// the response body. Responses other than rate limits and server errors
+// are returned as is.
+func (s *scheduler) Do(ctx context.Context, owner string, req *http.Request) (*http.Response, error) {
+	ol := s.ownerLimiter(owner)
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		if err := s.global.Wait(ctx); err != nil {
+			return nil, err
+		}
+		if err := ol.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req.Clone(ctx))
+		var wait time.Duration
+		if err == nil {
+			recordRateLimit(owner, resp.Header)
+			if !retryable(resp) {
+				return resp, nil
+			}
+			wait = retryAfter(resp)
+			if attempt == *retries {
+				return resp, nil
+			}
+			resp.Body.Close()
+			if wait > 0 && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+				ol.delay(clock.Now().Add(wait))
+			}
+		} else if attempt == *retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		if wait <= 0 {
+			wait = backoff
+			backoff = min(2*backoff, maxBackoff)
+		}
+		wait = min(wait, maxBackoff)
+		log.Printf("[Warn] Request %v [%v] failed (attempt %d), retrying in %v\n",
+			req.URL.Path, requestID(ctx), attempt+1, wait)
+		if err := sleepCtx(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func retryable(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusForbidden:
+		// secondary rate limits and exhausted budgets
+		return resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0"
+	case resp.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns how long GitHub asks us to wait, or 0.
+func retryAfter(resp *http.Response) time.Duration {
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return time.Duration(n) * time.Second
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if n, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Unix(n, 0).Sub(clock.Now())
+		}
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterWait(t *testing.T) {
+	c := useFakeClock(t)
+	l := newLimiter(2) // every 500ms
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.Wait(context.Background()) }()
+	c.BlockUntilWaiting()
+	c.Advance(499 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("second event before the interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Advance(time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	c := useFakeClock(t)
+	l := newLimiter(1)
+	l.delay(c.Now().Add(time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.Wait(ctx) }()
+	c.BlockUntilWaiting()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSchedulerRetryBackoff(t *testing.T) {
+	c := useFakeClock(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	s := &scheduler{global: newLimiter(0), owners: make(map[string]*limiter)}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := s.Do(context.Background(), "o", req)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	// backing off 1s, then 2s
+	for _, d := range []time.Duration{minBackoff, 2 * minBackoff} {
+		c.BlockUntilWaiting()
+		c.Advance(d - time.Millisecond)
+		if n := calls.Load(); n != int32(d/minBackoff) {
+			t.Fatalf("%d requests before the %v backoff passed", n, d)
+		}
+		c.Advance(time.Millisecond)
+	}
+	if resp := <-done; resp == nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %v, want 204", resp)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("%d requests, want 3", n)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// controlToken returns the bearer token required by the control
+// server's POST routes.
+func controlToken() string {
+	return os.Getenv("DEPLOYER_CONTROL_TOKEN")
+}
+
+// checkListen refuses to serve the control server beyond the loopback
+// interface without a control token.
+func checkListen(addr string) error {
+	if controlToken() != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("-listen on a non-loopback address requires $DEPLOYER_CONTROL_TOKEN")
+	}
+	return nil
+}
+
+// requireToken checks the control token of every request but GETs and
+// the webhook, which is signed and can't carry it.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := controlToken()
+		if r.Method != http.MethodGet && r.URL.Path != "/webhook" && token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid control token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the HTTP control server.
+func serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleStatus)
+	mux.HandleFunc("GET /config", handleConfig)
+	mux.HandleFunc("POST /pause/{key}", handlePause(true))
+	mux.HandleFunc("POST /resume/{key}", handlePause(false))
+	mux.HandleFunc("POST /trigger/{key}", handleTrigger)
+	mux.HandleFunc("GET /pending", handlePending)
+	mux.HandleFunc("GET /downloads", handleDownloads)
+	if approvalSecret() != "" {
+		mux.HandleFunc("POST /approve/{key}", handleApprove)
+	}
+	if webhookSecret() != "" {
+		mux.HandleFunc("POST /webhook", handleWebhook)
+	}
+
+	log.Printf("[Info] Listening on %v\n", addr)
+	if err := http.ListenAndServe(addr, requireToken(mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[Error] Write response: %v\n", err)
+	}
+}
+
+// handleStatus returns the status of every job,
+// with ?profile=name only of the jobs of that profile.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	ss := snapshotStatus()
+	if r.URL.Query().Has("profile") {
+		p := r.URL.Query().Get("profile")
+		ss = slices.DeleteFunc(ss, func(s JobStatus) bool { return s.Profile != p })
+	}
+	writeJSON(w, ss)
+}
+
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, effectiveConfig())
+}
+
+// handleTrigger runs the next poll cycle right away,
+// with ?force=true redeploying the job's latest artifact.
+func handleTrigger(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if findJob(key) == nil {
+		http.Error(w, "unknown job: "+key, http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("force") == "true" {
+		setForce(key)
+		log.Printf("[Info] Job %v forced redeploy requested\n", key)
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if err := setPaused(key, paused); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if paused {
+			log.Printf("[Info] Job %v paused\n", key)
+		} else {
+			log.Printf("[Info] Job %v resumed\n", key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
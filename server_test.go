@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckListen(t *testing.T) {
+	for _, c := range []struct {
+		addr, token string
+		ok          bool
+	}{
+		{"127.0.0.1:8080", "", true},
+		{"[::1]:8080", "", true},
+		{"localhost:8080", "", true},
+		{":8080", "", false},
+		{"0.0.0.0:8080", "", false},
+		{"10.0.0.1:8080", "", false},
+		{":8080", "t", true},
+	} {
+		t.Setenv("DEPLOYER_CONTROL_TOKEN", c.token)
+		if err := checkListen(c.addr); (err == nil) != c.ok {
+			t.Errorf("%v with token %q: got %v", c.addr, c.token, err)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	t.Setenv("DEPLOYER_CONTROL_TOKEN", "secret")
+	h := requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, c := range []struct {
+		method, path, auth string
+		code               int
+	}{
+		{"GET", "/status", "", http.StatusNoContent},
+		{"POST", "/pause/o.r.dist", "", http.StatusUnauthorized},
+		{"POST", "/trigger/o.r.dist", "Bearer wrong", http.StatusUnauthorized},
+		{"POST", "/approve/o.r.dist", "secret", http.StatusUnauthorized},
+		{"POST", "/resume/o.r.dist", "Bearer secret", http.StatusNoContent},
+		{"POST", "/webhook", "", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%v %v with %q: got %v, want %v", c.method, c.path, c.auth, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// signers are the commands signing snapshot manifests, by signManifest value.
+var signers = map[string]string{"gpg": "gpg", "cosign": "cosign"}
+
+func validateSigning(j Job) error {
+	if j.SignManifest == "" {
+		return nil
+	}
+	bin, ok := signers[j.SignManifest]
+	if !ok {
+		return fmt.Errorf("invalid signManifest %q", j.SignManifest)
+	}
+	if j.SnapshotPath == "" {
+		return errors.New("signManifest requires snapshotPath")
+	}
+	if j.SignKey == "" {
+		return errors.New("signManifest requires signKey")
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return fmt.Errorf("signManifest %v requires the %v CLI", j.SignManifest, bin)
+	}
+	return nil
+}
+
+// signManifest writes a detached signature of the manifest next to it
+// and returns its path: manifest.asc, an armored GPG signature by the
+// key with id SignKey, or manifest.sig, a cosign signature with the
+// cosign key file SignKey, whose password is read from $COSIGN_PASSWORD.
+func signManifest(ctx context.Context, j Job, manifest string) (string, error) {
+	var sig string
+	var cmd *exec.Cmd
+	switch j.SignManifest {
+	case "gpg":
+		sig = manifest + ".asc"
+		cmd = exec.CommandContext(ctx, "gpg", "--batch", "--yes", "--armor", "--detach-sign",
+			"--local-user", j.SignKey, "--output", sig, manifest)
+	case "cosign":
+		sig = manifest + ".sig"
+		cmd = exec.CommandContext(ctx, "cosign", "sign-blob", "--yes", "--key", j.SignKey,
+			"--output-signature", sig, manifest)
+	default:
+		return "", fmt.Errorf("invalid signManifest %q", j.SignManifest)
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("sign manifest: %v: %s", err, strings.TrimSpace(out.String()))
+	}
+	return sig, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/action-deployer/deploy"
+)
+
+// SnapshotManifest describes the content of a snapshot tarball.
+type SnapshotManifest struct {
+	ArtifactID int64             `json:"artifactId"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	RunID      int64             `json:"runId"`
+	SHA        string            `json:"sha"`
+	Files      map[string]string `json:"files"` // name -> sha256:<hex>
+}
+
+// writeSnapshot stores the files of the downloaded artifact as a read-only
+// <timestamp>-<sha>-<artifact id>.tar.gz in the job's snapshot path, next
+// to a manifest of the same name, signed if the job signs manifests, and
+// returns the tarball's path. A name taken by a snapshot of the same
+// second, e.g. of a forced redeploy, gets a counter like -2.
+func writeSnapshot(ctx context.Context, j Job, filename string, a *Artifact) (string, error) {
+	r, err := deploy.OpenZip(filename)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	sha := a.WorkflowRun.HeadSHA
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+	prefix := filepath.Join(j.SnapshotPath, fmt.Sprintf("%v-%v-%v", clock.Now().UTC().Format("20060102T150405Z"), sha, a.ID))
+
+	f, err := os.CreateTemp(j.SnapshotPath, ".snapshot-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	m := SnapshotManifest{
+		ArtifactID: a.ID,
+		CreatedAt:  a.CreatedAt,
+		RunID:      a.WorkflowRun.ID,
+		SHA:        a.WorkflowRun.HeadSHA,
+		Files:      make(map[string]string),
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() || deploy.PathMatches(zf.Name, j.Excludes) {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    zf.Name,
+			Mode:    0644,
+			Size:    int64(zf.UncompressedSize64),
+			ModTime: zf.Modified,
+		}); err != nil {
+			f.Close()
+			return "", err
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(tw, h), rc)
+		rc.Close()
+		if err != nil {
+			f.Close()
+			return "", fmt.Errorf("snapshot %v: %v", zf.Name, err)
+		}
+		m.Files[zf.Name] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	base, err := writeManifest(prefix, b)
+	if err != nil {
+		return "", err
+	}
+	if j.SignManifest != "" {
+		if _, err := signManifest(ctx, j, base+".json"); err != nil {
+			os.Remove(base + ".json")
+			return "", err
+		}
+	}
+	if err := os.Chmod(f.Name(), 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), base+".tar.gz"); err != nil {
+		return "", err
+	}
+	return base + ".tar.gz", nil
+}
+
+// writeManifest writes the manifest b as the first free read-only
+// <prefix>[-n].json and returns the snapshot's base name.
+func writeManifest(prefix string, b []byte) (string, error) {
+	for n := 1; ; n++ {
+		base := prefix
+		if n > 1 {
+			base = fmt.Sprintf("%v-%d", prefix, n)
+		}
+		f, err := os.OpenFile(base+".json", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(base + ".json")
+			return "", err
+		}
+		return base, nil
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteSnapshotSameSecond(t *testing.T) {
+	useWorkDir(t)
+	useFakeClock(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", SnapshotOnly: true, SnapshotPath: t.TempDir()}
+	a := &Artifact{ID: 7, WorkflowRun: WorkflowRun{HeadSHA: "0123456789"}}
+	filename := writeArtifact(t, map[string]string{"index.html": "v1"})
+
+	first, err := writeSnapshot(context.Background(), j, filename, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a forced redeploy of the same artifact in the same second
+	second, err := writeSnapshot(context.Background(), j, filename, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both snapshots are %v", first)
+	}
+	if !strings.HasSuffix(first, "-0123456-7.tar.gz") || !strings.HasSuffix(second, "-0123456-7-2.tar.gz") {
+		t.Fatalf("got snapshots %v and %v", first, second)
+	}
+	for _, p := range []string{first, second, strings.TrimSuffix(second, ".tar.gz") + ".json"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+	if es, _ := filepath.Glob(filepath.Join(j.SnapshotPath, "*")); len(es) != 4 {
+		t.Errorf("snapshot path holds %v", es)
+	}
+}
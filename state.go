@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	stateFile = "state.json"
+	stateDir  = "state" // of the per-job state files
+)
+
+var perJobState = flag.Bool("per-job-state", false, "keep the state of every job in its own file in state/, migrating log.json and state.json")
+
+// Record is the persisted state of a job besides lastUpdate.
+type Record struct {
+	Deploy *Deploy `json:"deploy,omitempty"` // last successful deploy
+
+	// id of the artifact that failed its health check, not deployed again
+	Unhealthy int64 `json:"unhealthy,omitempty"`
+
+	// deploy path created for a preview -> its branch, every
+	// path of a branch with e.g. {branch}/{sha}
+	PreviewPaths map[string]string `json:"previewPaths,omitempty"`
+	// branch -> the last deploy path created for it, from before
+	// previewPaths, only read to clean them up
+	Previews map[string]string `json:"previews,omitempty"`
+
+	// deploy path -> top-level directory -> hash of its files when last extracted
+	Dirs map[string]map[string]string `json:"dirs,omitempty"`
+
+	// deploy path -> destination name -> id of the artifact that last wrote it
+	Files map[string]map[string]int64 `json:"files,omitempty"`
+}
+
+type Deploy struct {
+	ArtifactID int64     `json:"artifactId"`
+	CreatedAt  time.Time `json:"createdAt"`
+	SHA        string    `json:"sha"`
+	DeployedAt time.Time `json:"deployedAt"`
+	Files      int       `json:"files"` // files in the artifact, not only the ones written
+	Size       uint64    `json:"size"`
+	Manifest   string    `json:"manifest,omitempty"` // digest of the manifest artifact, if any
+	Snapshot   string    `json:"snapshot,omitempty"` // path of the snapshot tarball, if any
+
+	Fingerprints map[string]string `json:"fingerprints,omitempty"` // deploy path -> fingerprint of its files
+}
+
+var records map[string]*Record // Owner.Repo.ArtifactName -> record, guarded by stateMu
+
+// recovered lists the corrupt state files moved aside while loading.
+var recovered []string
+
+// loadState decodes the state file filename into v and reports whether
+// it could. A corrupt file, e.g. truncated by an old version or broken
+// by hand, is moved aside to filename.corrupt-<timestamp> instead of
+// failing, so the deployer still starts, and its jobs without state.
+func loadState(filename string, v any) (bool, error) {
+	err := loadJSON(filename, v)
+	var pe *fs.PathError
+	if err == nil || errors.As(err, &pe) {
+		return err == nil, err
+	}
+	backup := filename + ".corrupt-" + clock.Now().UTC().Format("20060102T150405Z")
+	if rerr := os.Rename(filename, backup); rerr != nil {
+		return false, fmt.Errorf("%v: %v", filename, err)
+	}
+	log.Printf("[Error] State %v is corrupt: %v. Moved it to %v, its jobs start without state and redeploy their latest artifact\n", filename, err, backup)
+	recovered = append(recovered, filename)
+	return false, nil
+}
+
+func loadRecords() error {
+	records = make(map[string]*Record)
+	return loadProfiled(stateFile, records)
+}
+
+// jobRecord returns the record for key, creating it if needed.
+// The caller must hold stateMu.
+func jobRecord(key string) *Record {
+	r, ok := records[key]
+	if !ok {
+		r = &Record{}
+		records[key] = r
+	}
+	return r
+}
+
+// saveRecords persists the record of key, with -per-job-state only
+// that one. The caller must hold stateMu.
+func saveRecords(key string) error {
+	if *perJobState {
+		return saveJobState(key)
+	}
+	return saveProfiled(stateFile, records)
+}
+
+// JobState is the state of a job in its own file with -per-job-state.
+type JobState struct {
+	LastUpdate time.Time `json:"lastUpdate"`
+	Record     *Record   `json:"record,omitempty"`
+}
+
+// jobStatePath returns the state file of key in the state directory of its profile.
+func jobStatePath(key string) string {
+	for _, p := range configProfiles() {
+		if rest, ok := p.localKey(key); ok {
+			return p.path(filepath.Join(stateDir, rest+".json"))
+		}
+	}
+	return filepath.Join(stateDir, key+".json")
+}
+
+// saveJobState writes the state file of key. The caller must hold stateMu.
+func saveJobState(key string) error {
+	return saveJSON(jobStatePath(key), JobState{LastUpdate: lastUpdate[key], Record: records[key]})
+}
+
+// loadJobStates replaces the state loaded from log.json and state.json
+// with the state files of every profile. A profile without a state
+// directory is migrated by writing the files from the loaded state.
+// Unreadable files are logged and skipped, and corrupt ones moved
+// aside, so only their jobs lose their state.
+func loadJobStates() error {
+	for _, p := range configProfiles() {
+		dir := p.path(stateDir)
+		prefix := profilePrefix(p.Name)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			keys := make(map[string]bool)
+			for k := range lastUpdate {
+				keys[k] = true
+			}
+			for k := range records {
+				keys[k] = true
+			}
+			n := 0
+			for k := range keys {
+				if _, ok := p.localKey(k); ok {
+					if err := saveJobState(k); err != nil {
+						return err
+					}
+					n++
+				}
+			}
+			log.Printf("[Info] Migrated the state of %d jobs to %v\n", n, dir)
+			continue
+		}
+
+		for k := range lastUpdate {
+			if _, ok := p.localKey(k); ok {
+				delete(lastUpdate, k)
+			}
+		}
+		for k := range records {
+			if _, ok := p.localKey(k); ok {
+				delete(records, k)
+			}
+		}
+		es, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			name := e.Name()
+			if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+				continue
+			}
+			var s JobState
+			if ok, err := loadState(filepath.Join(dir, name), &s); !ok {
+				if err != nil {
+					log.Printf("[Error] State %v: %v, the job starts without state\n", filepath.Join(dir, name), err)
+				}
+				continue
+			}
+			key := prefix + strings.TrimSuffix(name, ".json")
+			if !s.LastUpdate.IsZero() {
+				lastUpdate[key] = s.LastUpdate
+			}
+			if s.Record != nil {
+				records[key] = s.Record
+			}
+		}
+	}
+	return nil
+}
+
+// RepairReport is the result of repair-state, printed with -json.
+type RepairReport struct {
+	OK        bool       `json:"ok"`
+	Recovered []string   `json:"recovered"` // corrupt files moved aside
+	Restored  []Restored `json:"restored"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Restored is a job whose last update was restored from its recorded deploy.
+type Restored struct {
+	Key        string    `json:"key"`
+	ArtifactID int64     `json:"artifactId"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// runRepairState restores the last update of the jobs that lost it,
+// e.g. with a corrupt log.json, from their recorded deploy, and writes
+// the state back. It takes the -pidfile lock, so it refuses to run
+// next to a daemon saving the same state, and reloads the state then.
+func runRepairState() bool {
+	rep := RepairReport{OK: true, Restored: []Restored{}}
+	if err := repairState(&rep); err != nil {
+		rep.OK, rep.Error = false, err.Error()
+	}
+	rep.Recovered = append([]string{}, recovered...)
+	printResult(rep, func() {
+		for _, f := range rep.Recovered {
+			fmt.Printf("%v was corrupt and moved aside\n", f)
+		}
+		for _, r := range rep.Restored {
+			fmt.Printf("%v: restored the last deploy of artifact %v created %v\n", r.Key, r.ArtifactID, r.CreatedAt)
+		}
+		if rep.Error != "" {
+			fmt.Fprintf(os.Stderr, "repair state: %v\n", rep.Error)
+		} else if len(rep.Recovered) == 0 && len(rep.Restored) == 0 {
+			fmt.Println("state is intact")
+		}
+	})
+	return rep.OK
+}
+
+func repairState(rep *RepairReport) error {
+	if *pidFile != "" {
+		if err := acquireLock(*pidFile); err != nil {
+			return err
+		}
+		defer releaseLock(*pidFile)
+	}
+	// saved by a daemon since it was loaded, before the lock
+	if err := reloadState(); err != nil {
+		return err
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	var keys []string
+	for k, r := range records {
+		if _, ok := lastUpdate[k]; !ok && r.Deploy != nil {
+			lastUpdate[k] = r.Deploy.CreatedAt
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		rep.Restored = append(rep.Restored, Restored{Key: k, ArtifactID: records[k].Deploy.ArtifactID, CreatedAt: records[k].Deploy.CreatedAt})
+	}
+
+	if *perJobState {
+		for _, k := range keys {
+			if err := saveJobState(k); err != nil {
+				return fmt.Errorf("write state: %v", err)
+			}
+		}
+		return nil
+	}
+	if err := saveProfiled(logFile, lastUpdate); err != nil {
+		return fmt.Errorf("write state: %v", err)
+	}
+	if err := saveProfiled(stateFile, records); err != nil {
+		return fmt.Errorf("write state: %v", err)
+	}
+	return nil
+}
+
+func recordDeploy(key string, d Deploy) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	jobRecord(key).Deploy = &d
+	return saveRecords(key)
+}
+
+// unchangedDirs returns the directories of hashes that are
+// unchanged since the last extraction into path.
+func unchangedDirs(key, path string, hashes map[string]string) []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	r, ok := records[key]
+	if !ok {
+		return nil
+	}
+	var dirs []string
+	for dir, h := range hashes {
+		if r.Dirs[path][dir] == h {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+func recordDirHashes(key, path string, hashes map[string]string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	r := jobRecord(key)
+	if r.Dirs == nil {
+		r.Dirs = make(map[string]map[string]string)
+	}
+	r.Dirs[path] = hashes
+	return saveRecords(key)
+}
+
+func lastDeploy(key string) *Deploy {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if r, ok := records[key]; ok && r.Deploy != nil {
+		d := *r.Deploy
+		return &d
+	}
+	return nil
+}
+
+// checkShrink refuses an artifact that has fewer files than the job's
+// minimum, or dramatically fewer files or bytes than the previous
+// deploy, which usually means a broken build.
+func checkShrink(j Job, key string, files int, size uint64) error {
+	if files < j.MinFiles {
+		return fmt.Errorf("artifact has %d files, fewer than minFiles %d, refusing to deploy", files, j.MinFiles)
+	}
+	if j.MaxShrinkPercent <= 0 {
+		return nil
+	}
+	prev := lastDeploy(key)
+	if prev == nil {
+		return nil
+	}
+	if prev.Files > 0 {
+		if p := 100 * float64(prev.Files-files) / float64(prev.Files); p > j.MaxShrinkPercent {
+			return fmt.Errorf("artifact has %.0f%% fewer files than the last deploy (%d -> %d), refusing to deploy", p, prev.Files, files)
+		}
+	}
+	if prev.Size > 0 && size < prev.Size {
+		if p := 100 * float64(prev.Size-size) / float64(prev.Size); p > j.MaxShrinkPercent {
+			return fmt.Errorf("artifact is %.0f%% smaller than the last deploy (%d -> %d bytes), refusing to deploy", p, prev.Size, size)
+		}
+	}
+	return nil
+}
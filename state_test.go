@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type failingJSON struct{}
+
+func (failingJSON) MarshalJSON() ([]byte, error) { return nil, errors.New("disk full") }
+
+// interruptedJSON stops the save like a crash, once the temp file exists.
+type interruptedJSON struct{ dir string }
+
+func (v interruptedJSON) MarshalJSON() ([]byte, error) {
+	es, _ := filepath.Glob(filepath.Join(v.dir, ".tmp-*"))
+	if len(es) == 0 {
+		return nil, errors.New("no temp file")
+	}
+	// what a write cut short leaves behind
+	os.WriteFile(es[0], []byte(`{"o.r.dist": {"deploy": {"artifa`), 0644)
+	panic("crash")
+}
+
+func TestSaveJSONInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "state.json")
+	want := map[string]*Record{"o.r.dist": {Deploy: &Deploy{ArtifactID: 7, CreatedAt: time.Unix(1, 0).UTC()}}}
+	if err := saveJSON(filename, want); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saveJSON(filename, map[string]any{"o.r.dist": failingJSON{}}); err == nil {
+		t.Fatal("saving an unencodable value succeeded")
+	}
+	if es, _ := filepath.Glob(filepath.Join(dir, ".tmp-*")); len(es) != 0 {
+		t.Fatalf("failed save left %v", es)
+	}
+	func() {
+		defer func() { recover() }()
+		saveJSON(filename, map[string]any{"o.r.dist": interruptedJSON{dir}})
+		t.Fatal("save wasn't interrupted")
+	}()
+
+	got := make(map[string]*Record)
+	if ok, err := loadState(filename, &got); !ok || err != nil {
+		t.Fatalf("loading the state after interrupted saves: %v, %v", ok, err)
+	}
+	if d := got["o.r.dist"].Deploy; d == nil || d.ArtifactID != 7 || !d.CreatedAt.Equal(want["o.r.dist"].Deploy.CreatedAt) {
+		t.Fatalf("got deploy %+v, want %+v", d, want["o.r.dist"].Deploy)
+	}
+}
+
+func TestRepairState(t *testing.T) {
+	dir := useWorkDir(t)
+	useState(t)
+	prev := *pidFile
+	*pidFile = filepath.Join(dir, "deployer.pid")
+	t.Cleanup(func() { *pidFile = prev })
+	created := time.Unix(1, 0).UTC()
+	if err := saveJSON(stateFile, map[string]*Record{"o.r.dist": {Deploy: &Deploy{ArtifactID: 7, CreatedAt: created}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a running daemon holds the lock
+	f, err := openLock(*pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep RepairReport
+	if err := repairState(&rep); err == nil {
+		t.Fatal("repaired while the lock is held")
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Fatalf("wrote %v while the lock is held", logFile)
+	}
+	f.Close()
+
+	rep = RepairReport{}
+	if err := repairState(&rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Restored) != 1 || rep.Restored[0].Key != "o.r.dist" || rep.Restored[0].ArtifactID != 7 {
+		t.Fatalf("restored %+v", rep.Restored)
+	}
+	got := make(map[string]time.Time)
+	if err := loadJSON(logFile, &got); err != nil || !got["o.r.dist"].Equal(created) {
+		t.Fatalf("%v holds %v, %v", logFile, got, err)
+	}
+}
+
+func TestCleanTempProfiles(t *testing.T) {
+	useWorkDir(t)
+	dir := t.TempDir()
+	prev := profiles
+	profiles = []Profile{{Name: "a", Dir: dir}}
+	t.Cleanup(func() { profiles = prev })
+	os.Mkdir(filepath.Join(dir, stateDir), 0755)
+	orphans := []string{filepath.Join(tempDir, "x.zip"), filepath.Join(dir, ".tmp-1"), filepath.Join(dir, stateDir, ".tmp-2")}
+	kept := []string{filepath.Join(dir, "state.json"), filepath.Join(dir, stateDir, "o.r.dist.json")}
+	for _, name := range append(orphans, kept...) {
+		if err := os.WriteFile(name, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cleanTemp()
+	for _, name := range orphans {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%v left: %v", name, err)
+		}
+	}
+	for _, name := range kept {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%v removed: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type JobStatus struct {
+	Key        string            `json:"key"`
+	Profile    string            `json:"profile,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Paused     bool              `json:"paused"`
+	LastRun    time.Time         `json:"lastRun"`
+	LastError  string            `json:"lastError,omitempty"`
+	LastUpdate time.Time         `json:"lastUpdate"` // created_at of the last deployed artifact
+	Pending    *Pending          `json:"pending,omitempty"`
+	Force      bool              `json:"force,omitempty"`     // redeploy on the next run even if already deployed
+	Approved   int64             `json:"approved,omitempty"`  // id of the artifact approved for deploy
+	Unhealthy  int64             `json:"unhealthy,omitempty"` // id of the artifact that failed its health check, from the record
+	RateLimit  *RateLimit        `json:"rateLimit,omitempty"` // of the job's owner
+	Interval   Duration          `json:"interval"`            // between polls, longer while backing off
+	Misses     int               `json:"misses,omitempty"`    // consecutive runs without an artifact
+	Failures   int               `json:"failures,omitempty"`  // consecutive failed runs
+	NextPoll   time.Time         `json:"nextPoll,omitempty"`  // while backing off
+	Download   string            `json:"download,omitempty"`  // queued or running, see -max-downloads
+
+	Fingerprints map[string]string `json:"fingerprints,omitempty"` // of the last deploy
+}
+
+// Pending is a detected artifact whose deploy is deferred.
+type Pending struct {
+	ArtifactID int64     `json:"artifactId"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Since      time.Time `json:"since"` // when the artifact was first detected
+	Reason     string    `json:"reason"`
+}
+
+var (
+	// stateMu guards statuses and lastUpdate,
+	// which are shared with the control server.
+	stateMu sync.Mutex
+
+	// Job key -> status. Kept in memory only, so paused jobs
+	// resume on restart but stay paused across config reloads.
+	statuses = make(map[string]*JobStatus)
+)
+
+// jobStatus returns the status for key, creating it if needed.
+// The caller must hold stateMu.
+func jobStatus(key string) *JobStatus {
+	s, ok := statuses[key]
+	if !ok {
+		s = &JobStatus{Key: key}
+		statuses[key] = s
+	}
+	return s
+}
+
+// recordRun records the outcome of a run of j and returns the
+// transition it made, see notifyTransition: failing once the job
+// failed FailingAfter runs in a row, recovered on its first success
+// after that, with the consecutive failures. A cancelled run, e.g.
+// on shutdown, doesn't count either way.
+func recordRun(j Job, key string, err error) (transition string, failures int) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := jobStatus(key)
+	s.LastRun = clock.Now()
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+	case err != nil:
+		if s.Failures++; s.Failures == j.failingAfter() {
+			return transitionFailing, s.Failures
+		}
+	default:
+		failures, s.Failures = s.Failures, 0
+		if failures >= j.failingAfter() {
+			return transitionRecovered, failures
+		}
+	}
+	return "", s.Failures
+}
+
+// markPending records that the deploy of a is deferred for reason and
+// returns when a was first detected. A different artifact restarts the clock.
+func markPending(key string, a *Artifact, reason string) time.Time {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := jobStatus(key)
+	if s.Pending == nil || s.Pending.ArtifactID != a.ID {
+		s.Pending = &Pending{ArtifactID: a.ID, CreatedAt: a.CreatedAt, Since: clock.Now()}
+	}
+	s.Pending.Reason = reason
+	return s.Pending.Since
+}
+
+func clearPending(key string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := jobStatus(key)
+	s.Pending = nil
+	s.Approved = 0
+}
+
+// backoff doubles the poll interval of the job after a run without
+// an artifact, up to its MissingBackoff, and resets it otherwise.
+func backoff(j Job, key string, missing bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := jobStatus(key)
+	if !missing {
+		s.Misses, s.Interval, s.NextPoll = 0, Duration{}, time.Time{}
+		return
+	}
+	s.Misses++
+	d := profileInterval(j.Profile)
+	for i := 0; i < s.Misses && d < j.MissingBackoff.Duration; i++ {
+		d *= 2
+	}
+	d = min(d, max(j.MissingBackoff.Duration, profileInterval(j.Profile)))
+	s.Interval = Duration{d}
+	s.NextPoll = clock.Now().Add(d)
+}
+
+// backingOff reports whether the job skips a poll at now while backing
+// off. A poll up to half an interval early counts as due, since polls
+// don't start exactly on time.
+func backingOff(j Job, now time.Time) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s, ok := statuses[jobKey(j)]
+	return ok && s.NextPoll.Sub(now) > profileInterval(j.Profile)/2
+}
+
+func isPaused(key string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return jobStatus(key).Paused
+}
+
+func setPaused(key string, paused bool) error {
+	if findJob(key) == nil {
+		return fmt.Errorf("unknown job: %v", key)
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	jobStatus(key).Paused = paused
+	return nil
+}
+
+// setForce makes the next run of the job redeploy
+// the latest artifact even if it's already deployed.
+func setForce(key string) error {
+	if findJob(key) == nil {
+		return fmt.Errorf("unknown job: %v", key)
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	jobStatus(key).Force = true
+	return nil
+}
+
+// takeForce reports and clears a forced redeploy of the job.
+func takeForce(key string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := jobStatus(key)
+	force := s.Force
+	s.Force = false
+	return force
+}
+
+// snapshotStatus returns a copy of the status of every job.
+func snapshotStatus() []JobStatus {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	js := currentJobs()
+	ss := make([]JobStatus, 0, len(js))
+	for _, j := range js {
+		key := jobKey(j)
+		s := *jobStatus(key)
+		s.Labels = j.Labels
+		s.Profile = j.Profile
+		s.LastUpdate = lastUpdate[key]
+		s.RateLimit = rateLimitFor(j.Owner)
+		if s.Interval.Duration == 0 {
+			s.Interval.Duration = profileInterval(j.Profile)
+		}
+		if r, ok := records[key]; ok {
+			s.Unhealthy = r.Unhealthy
+			if r.Deploy != nil {
+				s.Fingerprints = r.Deploy.Fingerprints
+			}
+		}
+		if s.Pending != nil {
+			p := *s.Pending
+			s.Pending = &p
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func findJob(key string) *Job {
+	js := currentJobs()
+	for i := range js {
+		if jobKey(js[i]) == key {
+			return &js[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	c := useFakeClock(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", MissingBackoff: Duration{30 * time.Minute}}
+	key := jobKey(j)
+	useState(t, j)
+
+	for _, want := range []time.Duration{10 * time.Minute, 20 * time.Minute, 30 * time.Minute, 30 * time.Minute} {
+		backoff(j, key, true)
+		s := jobStatus(key)
+		if s.Interval.Duration != want || !s.NextPoll.Equal(c.Now().Add(want)) {
+			t.Fatalf("after %d misses: interval %v, next poll %v, want %v", s.Misses, s.Interval, s.NextPoll, want)
+		}
+	}
+	backoff(j, key, false)
+	if s := jobStatus(key); s.Misses != 0 || s.Interval.Duration != 0 || !s.NextPoll.IsZero() {
+		t.Fatalf("not reset after a hit: %+v", s)
+	}
+}
+
+func TestRecordRunTransitions(t *testing.T) {
+	useFakeClock(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", FailingAfter: 2}
+	key := jobKey(j)
+	useState(t, j)
+	failed := errors.New("failed")
+
+	for i, c := range []struct {
+		err  error
+		want string
+	}{
+		{failed, ""},
+		{context.Canceled, ""},
+		{failed, transitionFailing},
+		{failed, ""},
+		{nil, transitionRecovered},
+		{nil, ""},
+		{failed, ""},
+		{nil, ""},
+	} {
+		if got, _ := recordRun(j, key, c.err); got != c.want {
+			t.Fatalf("run %d (%v): transition %q, want %q", i, c.err, got, c.want)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+)
 
 type Artifacts struct {
 	TotalCount int64      `json:"total_count"`
@@ -12,6 +17,7 @@ type Artifact struct {
 	NodeID             string      `json:"node_id"`
 	Name               string      `json:"name"`
 	SizeInBytes        int64       `json:"size_in_bytes"`
+	Digest             string      `json:"digest"` // sha256:<hex> of the zip, if known
 	URL                string      `json:"url"`
 	ArchiveDownloadURL string      `json:"archive_download_url"`
 	Expired            bool        `json:"expired"`
@@ -28,3 +34,76 @@ type WorkflowRun struct {
 	HeadBranch       string `json:"head_branch"`
 	HeadSHA          string `json:"head_sha"`
 }
+
+// fromFork reports whether the run built a pull request from a fork,
+// whose head branch isn't one of the repo's branches.
+func (r WorkflowRun) fromFork() bool {
+	return r.RepositoryID != 0 && r.HeadRepositoryID != 0 && r.HeadRepositoryID != r.RepositoryID
+}
+
+type Run struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	WorkflowID int64  `json:"workflow_id"`
+	HeadBranch string `json:"head_branch"`
+	HeadSHA    string `json:"head_sha"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+
+	Actor           User `json:"actor"`            // who the run belongs to
+	TriggeringActor User `json:"triggering_actor"` // who started it, differs for re-runs
+}
+
+type User struct {
+	Login string `json:"login"`
+}
+
+// actorAllowed reports whether the run was triggered by one of actors,
+// compared case-insensitively like GitHub logins.
+func (r *Run) actorAllowed(actors []string) bool {
+	login := r.TriggeringActor.Login
+	if login == "" {
+		login = r.Actor.Login
+	}
+	for _, a := range actors {
+		if strings.EqualFold(a, login) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWorkflow reports whether the run was produced by workflow w,
+// given as a file name (build.yml), a path (.github/workflows/build.yml)
+// or the workflow's display name.
+func (r *Run) matchesWorkflow(w string) bool {
+	return w == r.Path || w == path.Base(r.Path) || w == r.Name
+}
+
+type WorkflowRuns struct {
+	TotalCount   int64 `json:"total_count"`
+	WorkflowRuns []Run `json:"workflow_runs"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string like "10m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/action-deployer/deploy"
+)
+
+// swapDeploy builds the new tree in a sibling of the deploy path and
+// swaps it in with renames, so the served tree never has a mix of old
+// and new files. The sibling starts as hard links to the current tree,
+// keeping excluded files, and only changed files are written into it.
+// Between moving the old tree aside and the new one in, the deploy
+// path briefly doesn't exist. Nothing is swapped if a file failed to
+// extract, the new tree would be missing it.
+func swapDeploy(ctx context.Context, filename string, j Job, key string) (deploy.Result, error) {
+	dir := filepath.Clean(j.DeployPath)
+	next, old := dir+".next", dir+".old"
+	// leftovers of an interrupted swap
+	if err := os.RemoveAll(next); err != nil {
+		return deploy.Result{}, err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return deploy.Result{}, err
+	}
+
+	if err := linkTree(dir, next, j.OnPermissionDenied == "force"); err != nil {
+		os.RemoveAll(next)
+		return deploy.Result{}, err
+	}
+	tj := j
+	tj.DeployPath = next
+	res, err := unzipDiff(ctx, filename, tj, key)
+	if err != nil || len(res.Written) == 0 {
+		os.RemoveAll(next)
+		return res, err
+	}
+	if res.Failed > 0 {
+		os.RemoveAll(next)
+		return res, fmt.Errorf("%d files failed to extract, keeping the current tree", res.Failed)
+	}
+
+	if err := os.Rename(dir, old); err != nil {
+		os.RemoveAll(next)
+		return deploy.Result{}, err
+	}
+	if err := os.Rename(next, dir); err != nil {
+		// put the old tree back
+		os.Rename(old, dir)
+		os.RemoveAll(next)
+		return deploy.Result{}, err
+	}
+	if err := os.RemoveAll(old); err != nil || !j.Fsync {
+		return res, err
+	}
+	return res, deploy.SyncDir(filepath.Dir(dir))
+}
+
+// linkTree recreates the tree at src in dst with hard links to its files.
+// With copyReadOnly, files the process can't read and write are copied
+// instead, as making them writable for a forced write would change the
+// linked file of the live tree too.
+func linkTree(src, dst string, copyReadOnly bool) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case deploy.Managed(rel):
+			// e.g. temp files left by an interrupted extraction
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case d.IsDir():
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.Mkdir(target, fi.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if copyReadOnly {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if fi.Mode().Perm()&0600 != 0600 {
+					return copyMode(p, target, fi.Mode().Perm())
+				}
+			}
+			return linkOrCopy(p, target)
+		}
+	})
+}
+
+// copyMode copies src to dest with mode perm.
+func copyMode(src, dest string, perm fs.FileMode) error {
+	if err := copyFile(src, dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Chmod(dest, perm)
+}
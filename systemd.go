@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var systemdNotify = flag.Bool("systemd", false, "notify systemd when ready and send watchdog pings, for Type=notify units")
+
+var (
+	cycleMu    sync.Mutex
+	cycleStart time.Time // start of the running poll cycle or of its last wait for a build, zero between cycles
+)
+
+// sdNotify sends state to the socket in $NOTIFY_SOCKET, if any.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// abstract socket
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the watchdog timeout systemd expects
+// pings within, or 0 if the watchdog isn't enabled for us.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings the systemd watchdog at half its interval as long
+// as no poll cycle has been running for longer than the interval, so a
+// hanging cycle gets the service restarted. Waiting for a build, which
+// may take longer, counts as progress, see cycleProgress.
+func startWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		t := clock.NewTicker(interval / 2)
+		defer t.Stop()
+		for range t.C() {
+			cycleMu.Lock()
+			start := cycleStart
+			cycleMu.Unlock()
+			if !start.IsZero() && clock.Now().Sub(start) > interval {
+				log.Printf("[Warn] Poll cycle running for %v, stopping watchdog pings\n", clock.Now().Sub(start).Round(time.Second))
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("[Warn] systemd watchdog: %v\n", err)
+			}
+		}
+	}()
+}
+
+func markCycle(start time.Time) {
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+	cycleStart = start
+}
+
+// cycleProgress restarts the watchdog's measure of the running poll
+// cycle, for a job still polling the state of a build.
+func cycleProgress() {
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+	if !cycleStart.IsZero() {
+		cycleStart = clock.Now()
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	placeholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+	unsafeCharRe  = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+// isTemplate reports whether a deploy path contains placeholders.
+func isTemplate(p string) bool {
+	return placeholderRe.MatchString(p)
+}
+
+// deployRoot returns the static part of a deploy path,
+// i.e. the directory every expansion of the template lives in.
+func deployRoot(p string) string {
+	loc := placeholderRe.FindStringIndex(p)
+	if loc == nil {
+		return p
+	}
+	prefix := p[:loc[0]]
+	if strings.HasSuffix(prefix, "/") || strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		return filepath.Clean(prefix)
+	}
+	return filepath.Dir(prefix)
+}
+
+func templateValues(a *Artifact) map[string]string {
+	sha := a.WorkflowRun.HeadSHA
+	short := sha
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	return map[string]string{
+		"{branch}":      a.WorkflowRun.HeadBranch,
+		"{sha}":         sha,
+		"{short_sha}":   short,
+		"{artifact_id}": strconv.FormatInt(a.ID, 10),
+		"{run_id}":      strconv.FormatInt(a.WorkflowRun.ID, 10),
+		"{name}":        a.Name,
+	}
+}
+
+// validateTemplate checks that a deploy path only uses known placeholders.
+func validateTemplate(p string) error {
+	vs := templateValues(&Artifact{})
+	for _, ph := range placeholderRe.FindAllString(p, -1) {
+		if _, ok := vs[ph]; !ok {
+			return fmt.Errorf("unknown placeholder %v in deploy path", ph)
+		}
+	}
+	return nil
+}
+
+// pathSegment reduces a placeholder value to a single safe path segment.
+// Different values may reduce to the same one, e.g. the branches
+// feature/x and feature-x.
+func pathSegment(v string) string {
+	return unsafeCharRe.ReplaceAllString(v, "-")
+}
+
+// expandDeployPath fills the placeholders of a deploy path with the
+// artifact's metadata. Values are reduced to a single safe path segment,
+// so e.g. a branch named ../../etc can't escape the deploy root.
+// The branch of a fork's pull request isn't used, it could be named
+// like one of the repo's own.
+func expandDeployPath(p string, a *Artifact) (string, error) {
+	if !isTemplate(p) {
+		return p, nil
+	}
+
+	vs := templateValues(a)
+	var err error
+	if strings.Contains(p, "{branch}") && a.WorkflowRun.fromFork() {
+		return "", fmt.Errorf("artifact %v was built from a fork, not deploying its branch %v", a.ID, a.WorkflowRun.HeadBranch)
+	}
+	expanded := placeholderRe.ReplaceAllStringFunc(p, func(ph string) string {
+		v := pathSegment(vs[ph])
+		if v == "" || strings.Trim(v, ".") == "" {
+			err = fmt.Errorf("unsafe value %q for %v", vs[ph], ph)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Same check as for ZipSlip
+	root := filepath.Clean(deployRoot(p))
+	if !strings.HasPrefix(filepath.Clean(expanded), root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal deploy path: %s", expanded)
+	}
+	return expanded, nil
+}
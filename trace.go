@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export traces of job runs to, e.g. http://localhost:4318 (default disabled)")
+
+const (
+	maxSpanBatch  = 256
+	spanQueueSize = 4096
+	spanFlush     = 5 * time.Second
+)
+
+// span is a traced phase of a job run. A nil span, returned while
+// tracing is disabled, ignores every call.
+type span struct {
+	traceID, spanID, parentID string
+	name                      string
+	start                     time.Time
+	attrs                     map[string]any // string, int, int64 or bool
+	err                       error
+	end                       time.Time
+}
+
+type spanKey struct{}
+
+var (
+	spanQueue chan *span // nil while tracing is disabled
+	stopSpans = make(chan struct{})
+	exported  sync.WaitGroup
+)
+
+// startSpan starts a span named name, a child of the span of ctx if any,
+// and returns a context carrying it.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if spanQueue == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, start: clock.Now(), spanID: randomHex(8), attrs: make(map[string]any)}
+	if p := spanFrom(ctx); p != nil {
+		s.traceID, s.parentID = p.traceID, p.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *span) set(key string, v any) {
+	if s != nil {
+		s.attrs[key] = v
+	}
+}
+
+// setArtifact sets the attributes identifying artifact a.
+func (s *span) setArtifact(a *Artifact) {
+	if s != nil && a != nil {
+		s.attrs["deployer.artifact.id"] = a.ID
+		s.attrs["vcs.ref.head.revision"] = a.WorkflowRun.HeadSHA
+		if a.WorkflowRun.ID != 0 {
+			s.attrs["cicd.pipeline.run.id"] = a.WorkflowRun.ID
+		}
+	}
+}
+
+// finish ends the span, failed if err is set, and queues it for export.
+// Spans are dropped while the queue is full, e.g. with the collector down.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = clock.Now(), err
+	select {
+	case spanQueue <- s:
+	default:
+	}
+}
+
+// startTracing exports the finished spans to -otlp-endpoint in batches
+// until stopTracing.
+func startTracing() {
+	if *otlpEndpoint == "" {
+		return
+	}
+	url := strings.TrimSuffix(*otlpEndpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	headers := otlpHeaders()
+	spanQueue = make(chan *span, spanQueueSize)
+	exported.Add(1)
+	go func() {
+		defer exported.Done()
+		var batch []*span
+		t := clock.NewTicker(spanFlush)
+		defer t.Stop()
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := exportSpans(url, headers, batch); err != nil {
+				log.Printf("[Warn] Export %d spans: %v\n", len(batch), err)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case s := <-spanQueue:
+				if batch = append(batch, s); len(batch) >= maxSpanBatch {
+					flush()
+				}
+			case <-t.C():
+				flush()
+			case <-stopSpans:
+				for {
+					select {
+					case s := <-spanQueue:
+						if batch = append(batch, s); len(batch) >= maxSpanBatch {
+							flush()
+						}
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// stopTracing exports the spans still queued.
+func stopTracing() {
+	if spanQueue == nil {
+		return
+	}
+	close(stopSpans)
+	exported.Wait()
+}
+
+// otlpHeaders returns the headers of $OTEL_EXPORTER_OTLP_HEADERS,
+// e.g. "authorization=Bearer xyz,x-tenant=web".
+func otlpHeaders() http.Header {
+	h := make(http.Header)
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			h.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+	}
+	return h
+}
+
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+// exportSpans sends spans to url as OTLP/HTTP JSON.
+func exportSpans(url string, headers http.Header, spans []*span) error {
+	b, err := json.Marshal(otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header = headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", *userAgent)
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v: %v", url, resp.Status)
+	}
+	return nil
+}
+
+// otlpTraces returns the ExportTraceServiceRequest of spans
+// in the JSON encoding of OTLP.
+func otlpTraces(spans []*span) map[string]any {
+	ss := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		m := map[string]any{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != "" {
+			m["parentSpanId"] = s.parentID
+		}
+		if s.err != nil {
+			m["status"] = map[string]any{"code": 2, "message": s.err.Error()} // STATUS_CODE_ERROR
+		}
+		ss = append(ss, m)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{
+				"service.name":    "action-deployer",
+				"service.version": version,
+			})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "action-deployer", "version": version},
+				"spans": ss,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []any {
+	as := make([]any, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]any
+		switch v := v.(type) {
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		as = append(as, map[string]any{"key": k, "value": value})
+	}
+	return as
+}
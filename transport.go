@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	maxIdleConns        = flag.Int("max-idle-conns", 100, "max idle HTTP connections across all hosts, 0 for unlimited")
+	maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", 32, "max idle HTTP connections kept per host")
+	maxConnsPerHost     = flag.Int("max-conns-per-host", 0, "max HTTP connections per host, 0 for unlimited")
+	idleConnTimeout     = flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle HTTP connection is kept open")
+)
+
+// newTransport returns the transport for GitHub requests. All jobs talk
+// to the same few hosts, so far more idle connections are kept per host
+// than the stdlib default of 2, avoiding a new TLS handshake per request.
+// Responses are requested gzipped and decompressed by the transport,
+// e.g. listings of repos with many artifacts compress well.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          *maxIdleConns,
+		MaxIdleConnsPerHost:   *maxIdleConnsPerHost,
+		MaxConnsPerHost:       *maxConnsPerHost,
+		IdleConnTimeout:       *idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetJSONGzip(t *testing.T) {
+	want := Artifacts{TotalCount: 1, Artifacts: []Artifact{{ID: 7, Name: "dist"}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("Accept-Encoding %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		json.NewEncoder(gw).Encode(want)
+		gw.Close()
+	}))
+	defer srv.Close()
+	useGitHub(t)
+	prev := client
+	client = &http.Client{Transport: newTransport()}
+	t.Cleanup(func() { client = prev })
+
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", APIURL: srv.URL}
+	var got Artifacts
+	if err := getJSON(context.Background(), j, repoURL(j)+"/actions/artifacts", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.TotalCount != 1 || len(got.Artifacts) != 1 || got.Artifacts[0].ID != 7 || got.Artifacts[0].Name != "dist" {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
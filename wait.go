@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultWaitTimeout = 10 * time.Minute
+	waitPollInterval   = 15 * time.Second
+)
+
+// pendingRuns returns the queued or in-progress runs of the job's
+// workflow, on its branch if set, which may produce its artifact.
+func pendingRuns(ctx context.Context, j Job) ([]Run, error) {
+	var pending []Run
+	for _, status := range []string{"queued", "in_progress"} {
+		q := url.Values{"status": {status}, "per_page": {"100"}}
+		if j.Branch != "" {
+			q.Set("branch", j.Branch)
+		}
+		u := fmt.Sprintf("%s/actions/runs?%s", repoURL(j), q.Encode())
+		rs := new(WorkflowRuns)
+		if err := getJSON(ctx, j, u, rs); err != nil {
+			return nil, err
+		}
+		for _, r := range rs.WorkflowRuns {
+			if r.matchesWorkflow(j.Workflow) {
+				pending = append(pending, r)
+			}
+		}
+	}
+	return pending, nil
+}
+
+// waitForBuild blocks while a run that may produce the job's artifact
+// is still queued or in progress, up to the job's wait timeout. Each
+// poll keeps the systemd watchdog pinged, however long the wait.
+func waitForBuild(ctx context.Context, j Job, key string) error {
+	timeout := j.WaitTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	deadline := clock.Now().Add(timeout)
+
+	for {
+		runs, err := pendingRuns(ctx, j)
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			return nil
+		}
+		cycleProgress()
+		if clock.Now().After(deadline) {
+			log.Printf("[Warn] Job %v [%v]: run %v still %v after %v, deploying latest artifact\n",
+				key, requestID(ctx), runs[0].ID, runs[0].Status, timeout)
+			return nil
+		}
+		log.Printf("[Info] Job %v [%v]: waiting for run %v (%v)\n", key, requestID(ctx), runs[0].ID, runs[0].Status)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(waitPollInterval):
+		}
+	}
+}
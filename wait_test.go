@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForBuildRequiresWorkflow(t *testing.T) {
+	useGitHub(t)
+	j := Job{Owner: "o", Repo: "r", ArtifactName: "dist", DeployPath: t.TempDir(), WaitForBuild: true}
+	if err := validateJob(j); err == nil {
+		t.Fatal("waitForBuild without workflow is valid")
+	}
+	j.Workflow = "build.yml"
+	if err := validateJob(j); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForBuildKeepsWatchdog(t *testing.T) {
+	c := useFakeClock(t)
+	var building atomic.Bool
+	building.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs := WorkflowRuns{WorkflowRuns: []Run{{ID: 1, Path: ".github/workflows/lint.yml", Status: "in_progress"}}}
+		if building.Load() && r.URL.Query().Get("status") == "queued" {
+			rs.WorkflowRuns = append(rs.WorkflowRuns, Run{ID: 2, Path: ".github/workflows/build.yml", Status: "queued"})
+		}
+		json.NewEncoder(w).Encode(rs)
+	}))
+	t.Cleanup(srv.Close)
+	useGitHub(t)
+	j := Job{Owner: "o", Repo: "r", APIURL: srv.URL, Workflow: "build.yml"}
+
+	start := c.Now()
+	markCycle(start)
+	t.Cleanup(func() { markCycle(time.Time{}) })
+	done := make(chan error, 1)
+	go func() { done <- waitForBuild(context.Background(), j, "o.r.dist") }()
+
+	c.BlockUntilWaiting()
+	c.Advance(waitPollInterval)
+	c.BlockUntilWaiting()
+	cycleMu.Lock()
+	got := cycleStart
+	cycleMu.Unlock()
+	if want := start.Add(waitPollInterval); !got.Equal(want) {
+		t.Errorf("cycle started at %v while waiting, want %v", got, want)
+	}
+
+	// the lint run is still in progress, but isn't of the workflow
+	building.Store(false)
+	c.Advance(waitPollInterval)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxWebhookPayload = 25 << 20 // GitHub's limit
+
+var webhookMaxAge = flag.Duration("webhook-max-age", 5*time.Minute, "reject webhook deliveries for events older than this")
+
+var (
+	deliveriesMu sync.Mutex
+	deliveries   = make(map[string]time.Time) // delivery id -> when it was seen
+
+	// wake starts the next poll cycle early
+	wake = make(chan struct{}, 1)
+)
+
+// webhookSecret returns the secret webhook deliveries are signed with.
+// It's only read from the environment to keep it out of process listings.
+func webhookSecret() string {
+	return os.Getenv("DEPLOYER_WEBHOOK_SECRET")
+}
+
+type webhookEvent struct {
+	Action      string `json:"action"`
+	WorkflowRun struct {
+		UpdatedAt time.Time `json:"updated_at"`
+	} `json:"workflow_run"`
+	Repository struct {
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+// handleWebhook starts a poll cycle when a workflow run of a job's repo
+// completed. Deliveries must be signed with the webhook secret, are
+// only accepted once, and only while the run is recent, so a captured
+// delivery can't be replayed later.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !validSignature(webhookSecret(), body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "ping" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if event != "workflow_run" {
+		http.Error(w, "unsupported event "+event, http.StatusAccepted)
+		return
+	}
+	var e webhookEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the run's time is part of the signed payload, unlike any header
+	if age := clock.Now().Sub(e.WorkflowRun.UpdatedAt); age > *webhookMaxAge {
+		log.Printf("[Warn] Webhook: rejected delivery %v for a run from %v ago\n", r.Header.Get("X-GitHub-Delivery"), age.Round(time.Second))
+		http.Error(w, "stale delivery", http.StatusForbidden)
+		return
+	}
+	if !firstDelivery(r.Header.Get("X-GitHub-Delivery")) {
+		http.Error(w, "duplicate delivery", http.StatusOK)
+		return
+	}
+	if e.Action != "completed" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	for _, j := range currentJobs() {
+		if strings.EqualFold(j.Owner, e.Repository.Owner.Login) && strings.EqualFold(j.Repo, e.Repository.Name) {
+			log.Printf("[Info] Webhook: run of %v/%v completed, polling now\n", j.Owner, j.Repo)
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+			break
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validSignature(secret string, body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// firstDelivery records a delivery id and reports whether it's new.
+// Ids are forgotten once their deliveries would be rejected as stale.
+func firstDelivery(id string) bool {
+	if id == "" {
+		return false
+	}
+	deliveriesMu.Lock()
+	defer deliveriesMu.Unlock()
+	now := clock.Now()
+	for d, t := range deliveries {
+		if now.Sub(t) > *webhookMaxAge {
+			delete(deliveries, d)
+		}
+	}
+	if _, ok := deliveries[id]; ok {
+		return false
+	}
+	deliveries[id] = now
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Window is a time of day range a job may deploy in. A window ending
+// before it starts spans midnight and belongs to the day it starts.
+type Window struct {
+	Days  []string `json:"days,omitempty"` // "mon" to "sun", default every day
+	Start string   `json:"start"`          // "09:00"
+	End   string   `json:"end"`            // "17:30"
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseClock returns the minutes since midnight of "15:04".
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateWindows(j Job) error {
+	if _, err := time.LoadLocation(j.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %v", j.Timezone, err)
+	}
+	for _, w := range j.Windows {
+		for _, d := range w.Days {
+			if !slices.Contains(weekdays, strings.ToLower(d)) {
+				return fmt.Errorf("invalid window day %q", d)
+			}
+		}
+		start, err := parseClock(w.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return errors.New("window start and end are equal")
+		}
+	}
+	return nil
+}
+
+// inWindow reports whether the job may deploy at t,
+// always if it has no windows.
+func inWindow(j Job, t time.Time) bool {
+	if len(j.Windows) == 0 {
+		return true
+	}
+	loc := time.Local
+	if j.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(j.Timezone); err != nil {
+			return false
+		}
+	}
+	t = t.In(loc)
+	m := t.Hour()*60 + t.Minute()
+	today := weekdays[t.Weekday()]
+	yesterday := weekdays[(t.Weekday()+6)%7]
+	for _, w := range j.Windows {
+		start, err1 := parseClock(w.Start)
+		end, err2 := parseClock(w.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if start < end {
+			if w.onDay(today) && start <= m && m < end {
+				return true
+			}
+			continue
+		}
+		if w.onDay(today) && m >= start || w.onDay(yesterday) && m < end {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) onDay(day string) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(w.Days, func(d string) bool { return strings.EqualFold(d, day) })
+}